@@ -2,9 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/example/demo-csi-plugin/pkg/driver"
+	"github.com/example/demo-csi-plugin/pkg/version"
+	"github.com/go-logr/logr/funcr"
 	"k8s.io/klog/v2"
 )
 
@@ -15,12 +20,88 @@ var (
 		"Node ID (defaults to hostname)")
 	stateDir = flag.String("state-dir", "/var/lib/demo-csi/volumes",
 		"Directory where volume subdirectories are created")
+	maxParameters = flag.Int("max-parameters", 64,
+		"Maximum number of CreateVolume parameters / volume context entries (0 = unlimited)")
+	maxParametersBytes = flag.Int("max-parameters-bytes", 16*1024,
+		"Maximum combined size in bytes of CreateVolume parameters / volume context (0 = unlimited)")
+	registrationDir = flag.String("registration-dir", "",
+		"Kubelet plugin registration directory to prepare for node-driver-registrar (empty = skip)")
+	enableReflection = flag.Bool("enable-reflection", false,
+		"Register the gRPC reflection service (debugging only)")
+	defaultOpTimeout = flag.Duration("default-op-timeout", 5*time.Minute,
+		"Deadline applied to RPCs whose client did not set one (0 = none)")
+	emptyCapabilities = flag.String("empty-capabilities", "reject",
+		"How ValidateVolumeCapabilities treats an empty capability list: reject or default")
+	defaultAccessMode = flag.String("default-access-mode", "SINGLE_NODE_WRITER",
+		"Access mode confirmed for empty capability lists when --empty-capabilities=default")
+	stateDirFSType = flag.String("state-dir-fs-type", "",
+		"Filesystem type of --state-dir (e.g. xfs, ext4); detected via statfs when empty")
+	strictUnpublish = flag.Bool("strict-unpublish", false,
+		"Reject NodeUnpublishVolume when the target is mounted from a different volume")
+	fsGroupPolicy = flag.String("fs-group-policy", driver.FSGroupPolicyReadWriteOnceWithFSType,
+		"fsGroupPolicy declared in the CSIDriver object: File, ReadWriteOnceWithFSType or None")
+	stateDirMarker = flag.Bool("state-dir-marker", true,
+		"Write a marker file to --state-dir at startup and fail volume operations if it disappears")
+	rejectEscapingSymlinks = flag.Bool("reject-escaping-symlinks", false,
+		"Scan volumes at publish time and refuse those containing symlinks that point outside the volume")
+	unpublishWaitTimeout = flag.Duration("unpublish-wait-timeout", 30*time.Second,
+		"How long DeleteVolume waits for an in-flight NodeUnpublishVolume of the same volume")
+	debugAddr = flag.String("debug-addr", "",
+		"host:port for the debug HTTP server exposing /debug/health and /debug/volumes (empty = disabled)")
+	slowRPCThreshold = flag.Duration("slow-rpc-threshold", 5*time.Second,
+		"Log RPCs slower than this as warnings (0 = never)")
+	mountCheck = flag.String("mount-check", driver.MountCheckOff,
+		"Probe bind mount permission at startup: off, warn or fail")
+	unmountVerifyRetries = flag.Int("unmount-verify-retries", 5,
+		"Times NodeUnpublishVolume re-checks that the target is unmounted (0 = don't verify)")
+	reconcileMounts = flag.Bool("reconcile-mounts", true,
+		"Rebuild the published-target record from the mount table at startup before serving node RPCs")
+	snapshotDir = flag.String("snapshot-dir", "/var/lib/demo-csi/snapshots",
+		"Directory where snapshot copies are stored")
+	enableQuota = flag.Bool("enable-quota", false,
+		"Allow project-quota=true volumes to enforce capacity with XFS project quotas")
+	volumeStatsTimeout = flag.Duration("volume-stats-timeout", 10*time.Second,
+		"Time limit for walking a volume to compute its usage in NodeGetVolumeStats (0 = report filesystem usage)")
+	readOnlyConflict = flag.String("readonly-conflict", driver.ReadOnlyConflictReadOnlyWins,
+		"What NodePublishVolume does when mount flags include rw but the volume is read-only: readonly-wins or error")
+	metricsAddr = flag.String("metrics-addr", "",
+		"host:port for the Prometheus metrics server on /metrics (empty = disabled)")
+	tlsCert = flag.String("tls-cert", "",
+		"TLS certificate file for tcp:// endpoints (requires --tls-key)")
+	tlsKey = flag.String("tls-key", "",
+		"TLS private key file for tcp:// endpoints (requires --tls-cert)")
+	mountInfoPath = flag.String("mountinfo-path", "/proc/self/mountinfo",
+		"Mount table the node plugin reads to inspect mounts")
+	snapshotSync = flag.Bool("snapshot-sync", false,
+		"Flush the source filesystem before a snapshot copy and the snapshot before marking it complete")
+	publishLeaseTTL = flag.Duration("publish-lease-ttl", 0,
+		"Record which node has a single-node volume staged and refuse it on other nodes until the lease is this old (0 = disabled; needs shared --state-dir)")
+	configFile = flag.String("config", "",
+		"JSON file with logLevel and slowRPCThreshold, applied at startup and re-read on SIGHUP (empty = none)")
+	logFormat = flag.String("log-format", "text",
+		"Log output format: text (klog) or json (one object per line)")
+	assumeControllerCreated = flag.Bool("assume-controller-created", true,
+		"Create a missing volume directory at stage time (single-node); false fails with NotFound instead (multi-node)")
+	maxVolumesPerNode = flag.Int("max-volumes-per-node", 0,
+		"Maximum number of volumes published on this node, reported to the scheduler (0 = unlimited)")
 )
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 
+	switch *logFormat {
+	case "text":
+	case "json":
+		// klog still applies -v before handing a line to the logger, so the
+		// logger itself lets every level through.
+		klog.SetLogger(funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{LogCaller: funcr.All, LogTimestamp: true, Verbosity: 128}))
+	default:
+		klog.Fatalf("Invalid --log-format %q (use text or json)", *logFormat)
+	}
+
 	if *nodeID == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -29,10 +110,54 @@ func main() {
 		*nodeID = hostname
 	}
 
-	klog.Infof("Starting demo CSI plugin: node=%s endpoint=%s stateDir=%s",
-		*nodeID, *endpoint, *stateDir)
+	var emptyCapsMode csi.VolumeCapability_AccessMode_Mode
+	switch *emptyCapabilities {
+	case "reject":
+	case "default":
+		v, ok := csi.VolumeCapability_AccessMode_Mode_value[*defaultAccessMode]
+		if !ok {
+			klog.Fatalf("Unknown --default-access-mode %q", *defaultAccessMode)
+		}
+		emptyCapsMode = csi.VolumeCapability_AccessMode_Mode(v)
+	default:
+		klog.Fatalf("Invalid --empty-capabilities %q (use reject or default)", *emptyCapabilities)
+	}
+
+	klog.Infof("Starting demo CSI plugin: version=%s commit=%s node=%s endpoint=%s stateDir=%s",
+		version.Version(), version.GitCommit(), *nodeID, *endpoint, *stateDir)
 
-	d, err := driver.New(*nodeID, *stateDir)
+	d, err := driver.New(*nodeID, *stateDir, driver.Options{
+		MaxParameters:               *maxParameters,
+		MaxParametersBytes:          *maxParametersBytes,
+		RegistrationDir:             *registrationDir,
+		EnableReflection:            *enableReflection,
+		DefaultOpTimeout:            *defaultOpTimeout,
+		EmptyCapabilitiesAccessMode: emptyCapsMode,
+		FSType:                      *stateDirFSType,
+		StrictUnpublish:             *strictUnpublish,
+		FSGroupPolicy:               *fsGroupPolicy,
+		StateDirMarker:              *stateDirMarker,
+		RejectEscapingSymlinks:      *rejectEscapingSymlinks,
+		UnpublishWaitTimeout:        *unpublishWaitTimeout,
+		DebugAddr:                   *debugAddr,
+		SlowRPCThreshold:            *slowRPCThreshold,
+		MountCheck:                  *mountCheck,
+		UnmountVerifyRetries:        *unmountVerifyRetries,
+		ReconcileMounts:             *reconcileMounts,
+		SnapshotDir:                 *snapshotDir,
+		EnableQuota:                 *enableQuota,
+		VolumeStatsTimeout:          *volumeStatsTimeout,
+		ReadOnlyConflict:            *readOnlyConflict,
+		MetricsAddr:                 *metricsAddr,
+		TLSCertFile:                 *tlsCert,
+		TLSKeyFile:                  *tlsKey,
+		MountInfoPath:               *mountInfoPath,
+		SnapshotSync:                *snapshotSync,
+		PublishLeaseTTL:             *publishLeaseTTL,
+		ConfigFile:                  *configFile,
+		AssumeControllerCreated:     *assumeControllerCreated,
+		MaxVolumesPerNode:           *maxVolumesPerNode,
+	})
 	if err != nil {
 		klog.Fatalf("Failed to create driver: %v", err)
 	}
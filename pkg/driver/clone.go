@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// contentSourceDir resolves the directory a new volume is populated from: a
+// volume directory for clones, a snapshot copy for restores, or "" when the
+// request has no content source. The source IDs come from the PVC's
+// dataSource, so they are validated before they become paths.
+func (d *Driver) contentSourceDir(src *csi.VolumeContentSource) (string, error) {
+	switch {
+	case src == nil:
+		return "", nil
+	case src.GetVolume() != nil:
+		id := src.GetVolume().GetVolumeId()
+		if id == "" {
+			return "", status.Error(codes.InvalidArgument, "content source volume ID is required")
+		}
+		if err := validateID("content source volume ID", id); err != nil {
+			return "", err
+		}
+		dir := filepath.Join(d.stateDir, id)
+		if _, err := os.Stat(dir); err != nil {
+			if os.IsNotExist(err) {
+				return "", status.Errorf(codes.NotFound, "source volume %s not found", id)
+			}
+			return "", fsError(err, "failed to stat volume dir %q", dir)
+		}
+		if meta, err := d.loadMeta(id); err == nil && meta.Backing == backingLoop {
+			return "", status.Errorf(codes.InvalidArgument, "source volume %s is loop-backed and cannot be cloned", id)
+		}
+		return dir, nil
+	case src.GetSnapshot() != nil:
+		id := src.GetSnapshot().GetSnapshotId()
+		if id == "" {
+			return "", status.Error(codes.InvalidArgument, "content source snapshot ID is required")
+		}
+		if err := validateID("content source snapshot ID", id); err != nil {
+			return "", err
+		}
+		// Only snapshots with an info file are complete.
+		if _, err := d.loadSnapshotInfo(id); err != nil {
+			if os.IsNotExist(err) {
+				return "", status.Errorf(codes.NotFound, "source snapshot %s not found", id)
+			}
+			return "", status.Errorf(codes.Internal, "failed to load snapshot %s: %v", id, err)
+		}
+		return d.snapshotPath(id), nil
+	default:
+		return "", status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
+}
+
+// contentSourceCapacity returns the recorded size of a content source: the
+// capacity of a source volume, or the size of a snapshot. It is the capacity
+// of a clone or restore that asks for none.
+func (d *Driver) contentSourceCapacity(src *csi.VolumeContentSource) (int64, error) {
+	if vol := src.GetVolume(); vol != nil {
+		meta, err := d.loadMeta(vol.GetVolumeId())
+		if os.IsNotExist(err) {
+			// Created before metadata was recorded.
+			return 0, nil
+		}
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", vol.GetVolumeId(), err)
+		}
+		return meta.CapacityBytes, nil
+	}
+	info, err := d.loadSnapshotInfo(src.GetSnapshot().GetSnapshotId())
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "failed to load snapshot %s: %v", src.GetSnapshot().GetSnapshotId(), err)
+	}
+	return info.SizeBytes, nil
+}
+
+// populateVolume copies src into volumeDir. Like CreateSnapshot it copies into
+// a temporary directory and renames it into place, so that an interrupted
+// copy is never mistaken for a populated volume. A volumeDir left behind by
+// such an attempt (it has no metadata yet) is replaced.
+func (d *Driver) populateVolume(ctx context.Context, volumeID, src, volumeDir string) error {
+	tmpDir := filepath.Join(d.stateDir, ".tmp-"+volumeID)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fsError(err, "failed to clean up %q", tmpDir)
+	}
+	size, err := copyTree(ctx, src, tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return fsError(err, "failed to copy %q into volume %s", src, volumeID)
+	}
+	if err := os.RemoveAll(volumeDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fsError(err, "failed to clean up %q", volumeDir)
+	}
+	if err := os.Rename(tmpDir, volumeDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fsError(err, "failed to move volume %s into place", volumeID)
+	}
+	klog.V(2).Infof("CreateVolume: id=%s populated from %s (%d bytes)", volumeID, src, size)
+	return nil
+}
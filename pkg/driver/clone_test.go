@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cloneRequest asks for volume name populated from volume sourceID.
+func cloneRequest(name, sourceID string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID}},
+		},
+	}
+}
+
+func TestCreateVolumeContentSource(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	createTestVolume(t, d, "vol-1")
+	if err := os.MkdirAll(filepath.Join(d.stateDir, "vol-1", "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d.stateDir, "vol-1", "sub", "data"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	createTestSnapshot(t, d, "snap-1", "vol-1")
+
+	tests := []struct {
+		name string
+		req  *csi.CreateVolumeRequest
+	}{
+		{name: "from volume", req: cloneRequest("vol-2", "vol-1")},
+		{name: "from snapshot", req: restoreRequest("vol-3", "snap-1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			got, want := resp.GetVolume().GetContentSource(), tt.req.GetVolumeContentSource()
+			if got.GetVolume().GetVolumeId() != want.GetVolume().GetVolumeId() || got.GetSnapshot().GetSnapshotId() != want.GetSnapshot().GetSnapshotId() {
+				t.Errorf("ContentSource = %v, want %v", got, want)
+			}
+			data, err := os.ReadFile(filepath.Join(d.stateDir, tt.req.GetName(), "sub", "data"))
+			if err != nil || string(data) != "hello" {
+				t.Errorf("copied content = %q, %v, want %q", data, err, "hello")
+			}
+		})
+	}
+
+	for _, req := range []*csi.CreateVolumeRequest{cloneRequest("vol-4", "vol-9"), restoreRequest("vol-4", "snap-9")} {
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.NotFound {
+			t.Errorf("CreateVolume from missing source %v: got %v, want NotFound", req.GetVolumeContentSource(), err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-4")); !os.IsNotExist(err) {
+		t.Errorf("volume dir after a missing source: %v, want none", err)
+	}
+
+	caps, err := cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities: %v", err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		advertised = advertised || c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_CLONE_VOLUME
+	}
+	if !advertised {
+		t.Error("CLONE_VOLUME not advertised")
+	}
+}
+
+func TestCloneOfVolumeBeingCreated(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	ctx := context.Background()
+	createTestVolume(t, d, "vol-1")
+
+	// Hold vol-1 the way its own CreateVolume does while it is populated.
+	unlock, err := d.volumeLocks.lock(ctx, "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d.stateDir, "vol-1", "data"), []byte("partial"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.CreateVolume(ctx, cloneRequest("vol-2", "vol-1")); status.Code(err) != codes.Aborted {
+		t.Fatalf("clone of a volume being created: got %v, want Aborted", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-2")); !os.IsNotExist(err) {
+		t.Errorf("aborted clone left a volume dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(d.stateDir, "vol-1", "data"), []byte("complete"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	// The retry copies the finished source.
+	if _, err := cs.CreateVolume(ctx, cloneRequest("vol-2", "vol-1")); err != nil {
+		t.Fatalf("clone after the source was created: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(d.stateDir, "vol-2", "data")); err != nil || string(data) != "complete" {
+		t.Errorf("cloned content = %q, %v, want %q", data, err, "complete")
+	}
+}
+
+func TestCreateVolumeInheritsSourceCapacity(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	createTestVolume(t, d, "vol-1")
+	if err := os.WriteFile(filepath.Join(d.stateDir, "vol-1", "data"), make([]byte, 4096), 0640); err != nil {
+		t.Fatal(err)
+	}
+	createTestSnapshot(t, d, "snap-1", "vol-1")
+
+	tests := []struct {
+		name string
+		req  *csi.CreateVolumeRequest
+		want int64
+	}{
+		// A clone has the capacity of its source volume, a restore the
+		// size of its snapshot.
+		{name: "clone", req: cloneRequest("vol-2", "vol-1"), want: 1 << 20},
+		{name: "restore", req: restoreRequest("vol-3", "snap-1"), want: 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			if got := resp.GetVolume().GetCapacityBytes(); got != tt.want {
+				t.Errorf("capacity = %d, want %d", got, tt.want)
+			}
+			if meta, err := d.loadMeta(tt.req.GetName()); err != nil || meta.CapacityBytes != tt.want {
+				t.Errorf("recorded capacity = %v, %v, want %d", meta, err, tt.want)
+			}
+			// A retry without a size is the same request, not a conflict.
+			if _, err := cs.CreateVolume(context.Background(), tt.req); err != nil {
+				t.Errorf("repeated CreateVolume: %v", err)
+			}
+		})
+	}
+}
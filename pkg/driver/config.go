@@ -0,0 +1,93 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// reloadableConfig is the content of Options.ConfigFile: the settings that
+// can change while the driver runs. Absent keys keep their current value;
+// unknown keys (including structural settings such as the endpoint or the
+// state dir, which only flags set) make the whole file invalid.
+type reloadableConfig struct {
+	// LogLevel is the klog verbosity, as set by -v.
+	LogLevel *int32 `json:"logLevel,omitempty"`
+	// SlowRPCThreshold overrides --slow-rpc-threshold, e.g. "2s".
+	SlowRPCThreshold *string `json:"slowRPCThreshold,omitempty"`
+}
+
+// loadConfig reads and validates the config file, so that a bad file is
+// rejected before anything is applied.
+func (d *Driver) loadConfig() (*reloadableConfig, time.Duration, error) {
+	data, err := os.ReadFile(d.opts.ConfigFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var c reloadableConfig
+	if err := dec.Decode(&c); err != nil {
+		return nil, 0, fmt.Errorf("invalid config %q: %w", d.opts.ConfigFile, err)
+	}
+	if c.LogLevel != nil && *c.LogLevel < 0 {
+		return nil, 0, fmt.Errorf("invalid config %q: logLevel must not be negative", d.opts.ConfigFile)
+	}
+	threshold := time.Duration(d.slowRPCThreshold.Load())
+	if c.SlowRPCThreshold != nil {
+		threshold, err = time.ParseDuration(*c.SlowRPCThreshold)
+		if err != nil || threshold < 0 {
+			return nil, 0, fmt.Errorf("invalid config %q: bad slowRPCThreshold %q", d.opts.ConfigFile, *c.SlowRPCThreshold)
+		}
+	}
+	return &c, threshold, nil
+}
+
+// applyConfig loads the config file and applies every setting in it, or
+// none if the file is invalid. It logs each setting that changed.
+func (d *Driver) applyConfig() error {
+	c, threshold, err := d.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if c.LogLevel != nil && *c.LogLevel != d.logLevel.Load() {
+		var level klog.Level
+		if err := level.Set(strconv.Itoa(int(*c.LogLevel))); err != nil {
+			return fmt.Errorf("failed to set log level %d: %w", *c.LogLevel, err)
+		}
+		klog.Infof("Config: logLevel %d -> %d", d.logLevel.Swap(*c.LogLevel), *c.LogLevel)
+	}
+	if old := time.Duration(d.slowRPCThreshold.Swap(int64(threshold))); old != threshold {
+		klog.Infof("Config: slowRPCThreshold %v -> %v", old, threshold)
+	}
+	return nil
+}
+
+// klogVerbosity returns the current -v level. klog has no getter, so it
+// probes the levels that are enabled.
+func klogVerbosity() int32 {
+	var v int32
+	for v < 100 && klog.V(klog.Level(v+1)).Enabled() {
+		v++
+	}
+	return v
+}
+
+// reloadConfig is the SIGHUP handler. A failed reload keeps the current
+// settings.
+func (d *Driver) reloadConfig() {
+	if d.opts.ConfigFile == "" {
+		klog.Info("Received SIGHUP without --config, nothing to reload")
+		return
+	}
+	klog.Infof("Received SIGHUP, reloading %s", d.opts.ConfigFile)
+	if err := d.applyConfig(); err != nil {
+		klog.Errorf("Config reload failed, keeping current settings: %v", err)
+	}
+}
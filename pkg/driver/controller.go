@@ -2,8 +2,14 @@ package driver
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -11,60 +17,349 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// StorageClass parameters that set the owner of a new volume directory.
+// Applying them requires CAP_CHOWN.
+const (
+	paramVolumeUID = "volumeUID"
+	paramVolumeGID = "volumeGID"
+)
+
 type controllerServer struct {
 	d *Driver
 	// Embed the unimplemented server so that we satisfy the interface for RPC
-	// methods we don't implement (e.g. CreateSnapshot, ListVolumes, …).
+	// methods we don't implement (e.g. ListVolumes, ListSnapshots, …).
 	csi.UnimplementedControllerServer
 }
 
 // CreateVolume creates a directory on the host to back the requested volume.
 // Using the volume name as the ID makes the operation idempotent.
-func (s *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (s *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	if req.GetName() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume name is required")
 	}
+	if err := validateID("volume name", req.GetName()); err != nil {
+		return nil, err
+	}
 	if len(req.GetVolumeCapabilities()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
 	}
+	if err := s.d.validateParameters("parameters", req.GetParameters()); err != nil {
+		return nil, err
+	}
+	if err := s.d.validateParameters("mutable parameters", req.GetMutableParameters()); err != nil {
+		return nil, err
+	}
+	if err := validateMutableParameters(req.GetParameters(), req.GetMutableParameters()); err != nil {
+		return nil, err
+	}
+	// The metadata and VolumeContext carry both kinds of parameters.
+	params := recordedParameters(req.GetParameters(), req.GetMutableParameters())
+
+	uid, err := idParameter(req.GetParameters(), paramVolumeUID)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := idParameter(req.GetParameters(), paramVolumeGID)
+	if err != nil {
+		return nil, err
+	}
+
+	quota := wantsQuota(req.GetParameters())
+	if quota {
+		if err := s.d.checkQuotaSupported(); err != nil {
+			return nil, err
+		}
+		if req.GetCapacityRange().GetRequiredBytes() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "a quota-enforced volume needs a capacity")
+		}
+	}
+
+	loop := false
+	var loopFS string
+	switch backing := req.GetParameters()[paramBacking]; backing {
+	case "":
+		for _, c := range req.GetVolumeCapabilities() {
+			if c.GetBlock() != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "block access needs %s=%s", paramBacking, backingLoop)
+			}
+		}
+	case backingLoop:
+		loop = true
+		switch {
+		case quota:
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be combined with %s=%s", paramProjectQuota, paramBacking, backingLoop)
+		case req.GetCapacityRange().GetRequiredBytes() <= 0:
+			return nil, status.Error(codes.InvalidArgument, "a loop-backed volume needs a capacity")
+		case req.GetVolumeContentSource() != nil:
+			return nil, status.Error(codes.InvalidArgument, "loop-backed volumes cannot be created from a content source")
+		}
+		if loopFS, err = loopFSType(req.GetVolumeCapabilities()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown %s %q", paramBacking, backing)
+	}
+
+	topology, err := s.d.accessibleTopology(req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
 
 	// Use the name as the volume ID so repeated calls with the same name are
 	// idempotent (re-create returns the same volume).
 	volumeID := req.GetName()
 	volumeDir := filepath.Join(s.d.stateDir, volumeID)
+	unlock, err := s.d.volumeLocks.lock(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.d.checkStateDir(); err != nil {
+		return nil, err
+	}
+
+	// Determine capacity — we track it for the response but only enforce it
+	// when a project quota was requested (otherwise hostpath volumes share
+	// the underlying filesystem).
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+	contentSource := req.GetVolumeContentSource()
+
+	// The name is the only key, so a volume with this name created from
+	// another StorageClass (different parameters) or with another size must
+	// not be handed out as if it were this one. A clone or restore without
+	// a size took its size from the source.
+	existing, err := s.d.loadMeta(volumeID)
+	switch {
+	case err == nil:
+		if !maps.Equal(existing.Parameters, params) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with different parameters", volumeID)
+		}
+		inherited := capacityBytes == 0 && contentSource != nil
+		if existing.CapacityBytes != capacityBytes && !inherited {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with capacity %d, not %d",
+				volumeID, existing.CapacityBytes, capacityBytes)
+		}
+		capacityBytes = existing.CapacityBytes
+	case os.IsNotExist(err):
+		existing = nil
+	default:
+		return nil, status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", volumeID, err)
+	}
+
+	// Clones and restores are populated before the metadata is written; a
+	// repeated call for a finished volume must not copy again.
+	if existing == nil {
+		if snap := contentSource.GetSnapshot(); snap != nil {
+			unlock, err := s.d.snapshotLocks.rlock(ctx, snap.GetSnapshotId())
+			if err != nil {
+				return nil, err
+			}
+			defer unlock()
+		}
+		if vol := contentSource.GetVolume(); vol != nil {
+			// The source must not change while it is copied. Waiting for
+			// it could deadlock against a request holding the source and
+			// waiting for this volume, so a busy source (being created,
+			// expanded, deleted...) is retried by the caller instead.
+			if vol.GetVolumeId() == volumeID {
+				return nil, status.Errorf(codes.InvalidArgument, "volume %s cannot be cloned from itself", volumeID)
+			}
+			unlock, ok := s.d.volumeLocks.tryRLock(vol.GetVolumeId())
+			if !ok {
+				return nil, status.Errorf(codes.Aborted, "source volume %s is busy, retry later", vol.GetVolumeId())
+			}
+			defer unlock()
+		}
+		src, err := s.d.contentSourceDir(contentSource)
+		if err != nil {
+			return nil, err
+		}
+		if capacityBytes == 0 && contentSource != nil {
+			if capacityBytes, err = s.d.contentSourceCapacity(contentSource); err != nil {
+				return nil, err
+			}
+			if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && capacityBytes > limit {
+				return nil, status.Errorf(codes.OutOfRange, "source capacity %d exceeds limit bytes %d", capacityBytes, limit)
+			}
+		}
+		if src != "" {
+			if err := s.d.populateVolume(ctx, volumeID, src, volumeDir); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	if err := os.MkdirAll(volumeDir, 0750); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create volume dir %q: %v", volumeDir, err)
+		return nil, fsError(err, "failed to create volume dir %q", volumeDir)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(volumeDir, uid, gid); err != nil {
+			return nil, fsError(err, "failed to chown volume dir %q to %d:%d", volumeDir, uid, gid)
+		}
+		klog.V(2).Infof("CreateVolume: id=%s owner=%d:%d", volumeID, uid, gid)
 	}
 
 	klog.Infof("CreateVolume: id=%s path=%s", volumeID, volumeDir)
 
-	// Determine capacity — we track it for the response but don't enforce it
-	// (hostpath volumes share the underlying filesystem).
-	capacityBytes := int64(0)
-	if cr := req.GetCapacityRange(); cr != nil {
-		capacityBytes = cr.GetRequiredBytes()
+	// Record what was requested so it survives restarts. A repeated call
+	// keeps the original metadata.
+	if existing == nil {
+		meta := &volumeMeta{
+			CapacityBytes: capacityBytes,
+			Parameters:    params,
+			CreationTime:  time.Now().UTC(),
+		}
+		if quota {
+			// assignProjectQuota saves meta under the lock that allocates
+			// its project ID.
+			if err := s.d.assignProjectQuota(ctx, volumeID, volumeDir, capacityBytes, meta); err != nil {
+				return nil, err
+			}
+		} else {
+			if loop {
+				if err := s.d.createImage(ctx, volumeID, capacityBytes, loopFS); err != nil {
+					return nil, err
+				}
+				meta.Backing = backingLoop
+				meta.FSType = loopFS
+			}
+			if err := s.d.saveMeta(volumeID, meta); err != nil {
+				return nil, fsError(err, "failed to write metadata for volume %s", volumeID)
+			}
+		}
 	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: capacityBytes,
-			VolumeContext: req.GetParameters(),
+			VolumeId:           volumeID,
+			CapacityBytes:      capacityBytes,
+			VolumeContext:      volumeContext(params),
+			ContentSource:      contentSource,
+			AccessibleTopology: topology,
 		},
 	}, nil
 }
 
-// DeleteVolume removes the directory that backs the volume.
-// It is idempotent: deleting a non-existent volume succeeds.
-func (s *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+// idParameter parses the numeric user or group ID in params[key]. It returns
+// -1 (leave unchanged, as os.Chown expects) when the key is absent.
+func idParameter(params map[string]string, key string) (int, error) {
+	v, ok := params[key]
+	if !ok {
+		return -1, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "parameter %s=%q is not a numeric ID", key, v)
+	}
+	return int(id), nil
+}
+
+// paramDescription is a free-form note about the volume. It is the one
+// VolumeAttributesClass parameter we accept: hostpath volumes have no
+// attribute whose change after creation would affect the data path.
+const paramDescription = "description"
+
+// mutableParameters lists the VolumeAttributesClass parameters the driver
+// accepts in CreateVolume.MutableParameters.
+var mutableParameters = map[string]bool{
+	paramDescription: true,
+}
+
+// validateMutableParameters rejects mutable parameters we do not support,
+// rather than silently dropping them, and ones that repeat a StorageClass
+// parameter, since both are recorded in the same map.
+func validateMutableParameters(params, mutable map[string]string) error {
+	for k := range mutable {
+		if !mutableParameters[k] {
+			return status.Errorf(codes.InvalidArgument, "unsupported mutable parameter %q", k)
+		}
+		if _, ok := params[k]; ok {
+			return status.Errorf(codes.InvalidArgument, "parameter %q is given as both a parameter and a mutable parameter", k)
+		}
+	}
+	return nil
+}
+
+// recordedParameters merges the StorageClass and the mutable parameters of a
+// CreateVolume request, which validateMutableParameters has checked to be
+// disjoint.
+func recordedParameters(params, mutable map[string]string) map[string]string {
+	if len(mutable) == 0 {
+		return params
+	}
+	merged := make(map[string]string, len(params)+len(mutable))
+	maps.Copy(merged, params)
+	maps.Copy(merged, mutable)
+	return merged
+}
+
+// controllerParameters lists the StorageClass parameters only the controller
+// acts on. They stay in the volume metadata but are left out of the
+// VolumeContext, which kubelet passes to the node plugin and records on the
+// PV.
+var controllerParameters = map[string]bool{
+	paramVolumeUID:    true,
+	paramVolumeGID:    true,
+	paramProjectQuota: true,
+	paramBacking:      true,
+}
+
+// volumeContext returns the parameters that are passed on to the node.
+func volumeContext(params map[string]string) map[string]string {
+	vc := make(map[string]string, len(params))
+	for k, v := range params {
+		if !controllerParameters[k] {
+			vc[k] = v
+		}
+	}
+	return vc
+}
+
+// DeleteVolume removes the directory that backs the volume, including its
+// metadata file. It is idempotent: deleting a non-existent volume succeeds.
+func (s *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
+	// On single-node setups the node plugin may still be unmounting this
+	// volume; removing the directory underneath it would race the unmount.
+	if !s.d.unpublishing.wait(req.GetVolumeId(), s.d.opts.UnpublishWaitTimeout) {
+		return nil, status.Errorf(codes.Aborted, "volume %s is still being unpublished", req.GetVolumeId())
+	}
+	// Taken after the wait above: the unpublish we wait for needs the lock.
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	volumeDir := filepath.Join(s.d.stateDir, req.GetVolumeId())
+	img := s.d.imagePath(req.GetVolumeId())
+	if meta, err := s.d.loadMeta(req.GetVolumeId()); err == nil {
+		// Best effort: a stale limit on an unused project ID is harmless.
+		if meta.ProjectID != 0 {
+			if err := s.d.setQuotaLimit(ctx, meta.ProjectID, 0); err != nil {
+				klog.Warningf("DeleteVolume: id=%s: %v", req.GetVolumeId(), err)
+			}
+		}
+		// The node detaches the loop device on unstage; this only catches
+		// one left behind, and the controller may not see /dev at all.
+		if meta.Backing == backingLoop {
+			if err := detachImage(ctx, img); err != nil {
+				klog.Warningf("DeleteVolume: id=%s: %v", req.GetVolumeId(), err)
+			}
+		}
+	}
+	if err := os.Remove(img); err != nil && !os.IsNotExist(err) {
+		return nil, fsError(err, "failed to delete volume image %q", img)
+	}
 	if err := os.RemoveAll(volumeDir); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to delete volume dir %q: %v", volumeDir, err)
+		return nil, fsError(err, "failed to delete volume dir %q", volumeDir)
 	}
 
 	klog.Infof("DeleteVolume: id=%s path=%s", req.GetVolumeId(), volumeDir)
@@ -77,39 +372,214 @@ func (s *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *cs
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
-	if len(req.GetVolumeCapabilities()) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	caps := req.GetVolumeCapabilities()
+	if len(caps) == 0 {
+		// The spec requires at least one capability. Some older provisioners
+		// send none; in lenient mode we confirm the configured default instead.
+		mode := s.d.opts.EmptyCapabilitiesAccessMode
+		if mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+			return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+		}
+		klog.V(2).Infof("ValidateVolumeCapabilities: id=%s sent no capabilities, assuming %s", req.GetVolumeId(), mode)
+		caps = []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}}
 	}
 
-	for _, cap := range req.GetVolumeCapabilities() {
-		mode := cap.GetAccessMode().GetMode()
-		if mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER &&
-			mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY &&
-			mode != csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+	// Only raw loop-backed volumes (an image without a filesystem) can be
+	// used as block devices.
+	rawBlock := false
+	if meta, err := s.d.loadMeta(req.GetVolumeId()); err == nil {
+		rawBlock = meta.Backing == backingLoop && meta.FSType == ""
+	}
+	for _, cap := range caps {
+		if !supportedAccessMode(cap.GetAccessMode().GetMode()) {
 			return &csi.ValidateVolumeCapabilitiesResponse{
 				Message: "unsupported access mode",
 			}, nil
 		}
+		if (cap.GetBlock() != nil) != rawBlock {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: "unsupported access type",
+			}, nil
+		}
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: req.GetVolumeCapabilities(),
+			VolumeCapabilities: caps,
+		},
+	}, nil
+}
+
+// supportedAccessMode reports whether the driver can serve volumes in mode.
+func supportedAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// ControllerExpandVolume grows a volume to the requested size. Hostpath
+// volumes share the underlying filesystem, so there is nothing to resize: we
+// record the new capacity and raise the project quota if the volume has one.
+// No node-side expansion is needed.
+func (s *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	cr := req.GetCapacityRange()
+	if cr == nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity range is required")
+	}
+	capacityBytes := cr.GetRequiredBytes()
+	if limit := cr.GetLimitBytes(); limit > 0 && capacityBytes > limit {
+		return nil, status.Errorf(codes.OutOfRange, "required bytes %d exceed limit bytes %d", capacityBytes, limit)
+	}
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	volumeDir := filepath.Join(s.d.stateDir, req.GetVolumeId())
+	if _, err := os.Stat(volumeDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+		}
+		return nil, fsError(err, "failed to stat volume dir %q", volumeDir)
+	}
+
+	meta, err := s.d.loadMeta(req.GetVolumeId())
+	if os.IsNotExist(err) {
+		// Created before metadata was recorded.
+		meta = &volumeMeta{CreationTime: time.Now().UTC()}
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", req.GetVolumeId(), err)
+	}
+
+	// Loop-backed volumes grow their image here; the node then refreshes
+	// the loop device and grows the filesystem in NodeExpandVolume.
+	loop := meta.Backing == backingLoop
+
+	// Volumes never shrink: a smaller request is satisfied by the current size.
+	if meta.CapacityBytes >= capacityBytes {
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: meta.CapacityBytes, NodeExpansionRequired: loop}, nil
+	}
+
+	if loop {
+		if err := s.d.growImage(req.GetVolumeId(), capacityBytes); err != nil {
+			return nil, err
+		}
+	}
+	if meta.ProjectID != 0 {
+		if err := s.d.setQuotaLimit(ctx, meta.ProjectID, capacityBytes); err != nil {
+			return nil, err
+		}
+	}
+	meta.CapacityBytes = capacityBytes
+	if err := s.d.saveMeta(req.GetVolumeId(), meta); err != nil {
+		return nil, fsError(err, "failed to write metadata for volume %s", req.GetVolumeId())
+	}
+	klog.Infof("ControllerExpandVolume: id=%s capacity=%d", req.GetVolumeId(), capacityBytes)
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: loop,
+	}, nil
+}
+
+// ControllerGetVolume reports a volume and its health for the
+// external-health-monitor-controller. A missing or unreadable directory is
+// reported as an abnormal condition rather than an error, so the monitor can
+// raise an event on the PVC.
+func (s *controllerServer) ControllerGetVolume(_ context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
+	vol := &csi.Volume{VolumeId: req.GetVolumeId()}
+	meta, err := s.d.loadMeta(req.GetVolumeId())
+	switch {
+	case err == nil:
+		vol.CapacityBytes = meta.CapacityBytes
+		vol.VolumeContext = volumeContext(meta.Parameters)
+	case !os.IsNotExist(err):
+		klog.Warningf("ControllerGetVolume: id=%s: %v", req.GetVolumeId(), err)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: vol,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: volumeCondition(filepath.Join(s.d.stateDir, req.GetVolumeId())),
 		},
 	}, nil
 }
 
+// volumeCondition reports whether volumeDir exists and can be listed.
+func volumeCondition(volumeDir string) *csi.VolumeCondition {
+	f, err := os.Open(volumeDir)
+	if os.IsNotExist(err) {
+		return &csi.VolumeCondition{Abnormal: true, Message: "volume path missing"}
+	}
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume path unreadable: %v", err)}
+	}
+	return &csi.VolumeCondition{Message: "volume is healthy"}
+}
+
+// GetCapacity reports the space left on the filesystem backing stateDir. All
+// volumes share it, so the parameters and topology of the request do not
+// change the answer.
+func (s *controllerServer) GetCapacity(_ context.Context, _ *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.d.stateDir, &st); err != nil {
+		return nil, fsError(err, "statfs %q failed", s.d.stateDir)
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: int64(st.Bavail) * int64(st.Bsize),
+	}, nil
+}
+
 // ControllerGetCapabilities reports the capabilities this controller implements.
 func (s *controllerServer) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: []*csi.ControllerServiceCapability{
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
-			},
+			controllerCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+			controllerCapability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME),
+			controllerCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT),
+			controllerCapability(csi.ControllerServiceCapability_RPC_GET_VOLUME),
+			controllerCapability(csi.ControllerServiceCapability_RPC_VOLUME_CONDITION),
+			controllerCapability(csi.ControllerServiceCapability_RPC_GET_CAPACITY),
+			controllerCapability(csi.ControllerServiceCapability_RPC_CLONE_VOLUME),
 		},
 	}, nil
 }
+
+func controllerCapability(t csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{Type: t},
+		},
+	}
+}
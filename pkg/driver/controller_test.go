@@ -0,0 +1,369 @@
+package driver
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeConcurrentSameName(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+
+	const calls = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("CreateVolume: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(d.stateDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, e.Name())
+		}
+	}
+	if len(dirs) != 1 || dirs[0] != "vol-1" {
+		t.Errorf("state dir holds %v, want only vol-1", dirs)
+	}
+}
+
+func TestCreateVolumeMutableParameters(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	req := &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"tier": "gold"},
+		MutableParameters:  map[string]string{paramDescription: "scratch space"},
+	}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	want := map[string]string{"tier": "gold", paramDescription: "scratch space"}
+	if got := resp.GetVolume().GetVolumeContext(); !maps.Equal(got, want) {
+		t.Errorf("VolumeContext = %v, want %v", got, want)
+	}
+	meta, err := d.loadMeta("vol-1")
+	if err != nil {
+		t.Fatalf("loadMeta: %v", err)
+	}
+	if !maps.Equal(meta.Parameters, want) {
+		t.Errorf("recorded parameters = %v, want %v", meta.Parameters, want)
+	}
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Errorf("repeated CreateVolume: %v", err)
+	}
+	req.MutableParameters = map[string]string{paramDescription: "something else"}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateVolume with another description: got %v, want AlreadyExists", err)
+	}
+}
+
+func TestCreateVolumeMutableParametersRejected(t *testing.T) {
+	cs := &controllerServer{d: newTestDriver(t, Options{})}
+	tests := map[string]struct {
+		params, mutable map[string]string
+	}{
+		"unsupported": {mutable: map[string]string{"iops": "3000"}},
+		"repeated":    {params: map[string]string{paramDescription: "a"}, mutable: map[string]string{paramDescription: "b"}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol-" + name,
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+				Parameters:         tt.params,
+				MutableParameters:  tt.mutable,
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("CreateVolume: got %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeWaitsForUnpublish(t *testing.T) {
+	d := newTestDriver(t, Options{UnpublishWaitTimeout: 50 * time.Millisecond})
+	cs := &controllerServer{d: d}
+	ctx := context.Background()
+	if _, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	}); err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	end := d.unpublishing.begin("vol-1")
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"}); status.Code(err) != codes.Aborted {
+		t.Fatalf("DeleteVolume during an unpublish: got %v, want Aborted", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-1")); err != nil {
+		t.Fatalf("volume removed while being unpublished: %v", err)
+	}
+
+	// An unpublish that ends within the wait lets the delete go ahead.
+	d.opts.UnpublishWaitTimeout = time.Minute
+	time.AfterFunc(20*time.Millisecond, end)
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"}); err != nil {
+		t.Fatalf("DeleteVolume after the unpublish: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-1")); !os.IsNotExist(err) {
+		t.Errorf("volume still present after DeleteVolume: %v", err)
+	}
+}
+
+func TestVolumeContextExcludesControllerParameters(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	params := map[string]string{
+		"tier":         "gold",
+		paramVolumeUID: "1000",
+		paramVolumeGID: "1000",
+	}
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         params,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	want := map[string]string{"tier": "gold"}
+	if got := resp.GetVolume().GetVolumeContext(); !maps.Equal(got, want) {
+		t.Errorf("CreateVolume VolumeContext = %v, want %v", got, want)
+	}
+
+	get, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"})
+	if err != nil {
+		t.Fatalf("ControllerGetVolume: %v", err)
+	}
+	if got := get.GetVolume().GetVolumeContext(); !maps.Equal(got, want) {
+		t.Errorf("ControllerGetVolume VolumeContext = %v, want %v", got, want)
+	}
+
+	meta, err := d.loadMeta("vol-1")
+	if err != nil {
+		t.Fatalf("loadMeta: %v", err)
+	}
+	if !maps.Equal(meta.Parameters, params) {
+		t.Errorf("recorded parameters = %v, want all of %v", meta.Parameters, params)
+	}
+}
+
+func TestValidateVolumeCapabilitiesEmpty(t *testing.T) {
+	t.Run("strict", func(t *testing.T) {
+		d := newTestDriver(t, Options{})
+		createTestVolume(t, d, "vol-1")
+		_, err := (&controllerServer{d: d}).ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-1"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ValidateVolumeCapabilities without capabilities: got %v, want InvalidArgument", err)
+		}
+	})
+	t.Run("default mode", func(t *testing.T) {
+		mode := csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+		d := newTestDriver(t, Options{EmptyCapabilitiesAccessMode: mode})
+		createTestVolume(t, d, "vol-1")
+		resp, err := (&controllerServer{d: d}).ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-1"})
+		if err != nil {
+			t.Fatalf("ValidateVolumeCapabilities without capabilities: %v", err)
+		}
+		caps := resp.GetConfirmed().GetVolumeCapabilities()
+		if len(caps) != 1 || caps[0].GetAccessMode().GetMode() != mode || caps[0].GetMount() == nil {
+			t.Errorf("confirmed %v, want one %s mount capability", caps, mode)
+		}
+	})
+	t.Run("unsupported default mode", func(t *testing.T) {
+		opts := Options{EmptyCapabilitiesAccessMode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+		if _, err := New("test-node", filepath.Join(t.TempDir(), "volumes"), opts); err == nil {
+			t.Error("New accepted an unsupported default access mode")
+		}
+	})
+}
+
+func TestCreateVolumeOwnership(t *testing.T) {
+	tests := []struct {
+		name             string
+		params           map[string]string
+		wantUID, wantGID uint32
+		wantCode         codes.Code
+	}{
+		{name: "uid and gid", params: map[string]string{paramVolumeUID: "1234", paramVolumeGID: "5678"}, wantUID: 1234, wantGID: 5678},
+		{name: "gid only", params: map[string]string{paramVolumeGID: "5678"}, wantGID: 5678},
+		{name: "negative uid", params: map[string]string{paramVolumeUID: "-1"}, wantCode: codes.InvalidArgument},
+		{name: "name as gid", params: map[string]string{paramVolumeGID: "users"}, wantCode: codes.InvalidArgument},
+		{name: "uid out of range", params: map[string]string{paramVolumeUID: "99999999999"}, wantCode: codes.InvalidArgument},
+		{name: "empty gid", params: map[string]string{paramVolumeGID: ""}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantCode == codes.OK && os.Geteuid() != 0 {
+				t.Skip("needs root to change ownership")
+			}
+			d := newTestDriver(t, Options{})
+			_, err := (&controllerServer{d: d}).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol-1",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+				Parameters:         tt.params,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolume: got %v, want %v", err, tt.wantCode)
+			}
+			fi, statErr := os.Stat(filepath.Join(d.stateDir, "vol-1"))
+			if err != nil {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("rejected CreateVolume left a volume dir behind: %v", statErr)
+				}
+				return
+			}
+			if statErr != nil {
+				t.Fatal(statErr)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			if st.Uid != tt.wantUID || st.Gid != tt.wantGID {
+				t.Errorf("volume dir owned by %d:%d, want %d:%d", st.Uid, st.Gid, tt.wantUID, tt.wantGID)
+			}
+		})
+	}
+}
+
+func TestControllerGetVolumeCondition(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	createTestVolume(t, d, "vol-1")
+	volumeDir := filepath.Join(d.stateDir, "vol-1")
+	hidden := filepath.Join(d.stateDir, ".hidden-vol-1")
+	condition := func() *csi.VolumeCondition {
+		t.Helper()
+		resp, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"})
+		if err != nil {
+			t.Fatalf("ControllerGetVolume: %v", err)
+		}
+		return resp.GetStatus().GetVolumeCondition()
+	}
+
+	if c := condition(); c.GetAbnormal() {
+		t.Errorf("condition with the directory present = %v, want normal", c)
+	}
+	// Move the directory away and back rather than deleting it, so the
+	// volume comes back intact.
+	if err := os.Rename(volumeDir, hidden); err != nil {
+		t.Fatal(err)
+	}
+	if c := condition(); !c.GetAbnormal() || !strings.Contains(c.GetMessage(), "missing") {
+		t.Errorf("condition with the directory missing = %v, want abnormal", c)
+	}
+	if err := os.Rename(hidden, volumeDir); err != nil {
+		t.Fatal(err)
+	}
+	if c := condition(); c.GetAbnormal() {
+		t.Errorf("condition with the directory restored = %v, want normal", c)
+	}
+
+	caps, err := cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities: %v", err)
+	}
+	want := map[csi.ControllerServiceCapability_RPC_Type]bool{
+		csi.ControllerServiceCapability_RPC_GET_VOLUME:       true,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION: true,
+	}
+	for _, c := range caps.GetCapabilities() {
+		delete(want, c.GetRpc().GetType())
+	}
+	if len(want) != 0 {
+		t.Errorf("capabilities not advertised: %v", want)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	available := func() int64 {
+		t.Helper()
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(d.stateDir, &st); err != nil {
+			t.Fatal(err)
+		}
+		return int64(st.Bavail) * int64(st.Bsize)
+	}
+	for _, req := range []*csi.GetCapacityRequest{
+		{},
+		// Parameters and topology do not matter: there is one backing filesystem.
+		{
+			Parameters:         map[string]string{"tier": "gold"},
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyKeyNode: "test-node"}},
+		},
+	} {
+		before := available()
+		resp, err := cs.GetCapacity(context.Background(), req)
+		if err != nil {
+			t.Fatalf("GetCapacity(%v): %v", req, err)
+		}
+		// Other processes may use space meanwhile; the result must match
+		// one of the readings around the call.
+		if got, after := resp.GetAvailableCapacity(), available(); got != before && got != after {
+			t.Errorf("GetCapacity(%v) = %d, want statfs available bytes %d", req, got, before)
+		}
+	}
+}
+
+func TestCreateVolumeRepeatedCapacity(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	create := func(size int64) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "vol-1",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		})
+	}
+
+	if _, err := create(1 << 20); err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	resp, err := create(1 << 20)
+	if err != nil {
+		t.Fatalf("identical repeated CreateVolume: %v", err)
+	}
+	if got := resp.GetVolume().GetCapacityBytes(); got != 1<<20 {
+		t.Errorf("repeated CreateVolume capacity = %d, want %d", got, 1<<20)
+	}
+	if _, err := create(2 << 20); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateVolume with another capacity: got %v, want AlreadyExists", err)
+	}
+	if meta, err := d.loadMeta("vol-1"); err != nil || meta.CapacityBytes != 1<<20 {
+		t.Errorf("metadata after the conflict = %v, %v, want capacity %d", meta, err, 1<<20)
+	}
+}
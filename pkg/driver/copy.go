@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// copyChunkSize is how much copyFile copies between checks of its context.
+const copyChunkSize = 64 << 20
+
+// copyTree recursively copies the contents of src into dst, which must not
+// exist yet. Regular files, directories and symlinks are copied with their
+// mode and ownership; other file types (sockets, devices, FIFOs) and the
+// volume metadata file are skipped.
+// It returns the number of bytes of file data copied, and stops with
+// ctx.Err() once ctx is done.
+func copyTree(ctx context.Context, src, dst string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(src, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == metaFileName {
+			// Volume metadata describes the source, not the copy.
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			n, err := copyFile(ctx, path, target, fi.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			total += n
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			klog.V(2).Infof("copyTree: skipping special file %q (%s)", path, fi.Mode().Type())
+			return nil
+		}
+		return copyOwner(target, fi)
+	})
+	if err != nil {
+		return total, fmt.Errorf("copy %q → %q: %w", src, dst, err)
+	}
+	return total, nil
+}
+
+// copyFile copies the regular file src to a new file dst with mode perm. A
+// large file is abandoned halfway through when ctx is done.
+func copyFile(ctx context.Context, src, dst string, perm fs.FileMode) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return 0, err
+	}
+	// Copy in chunks to notice ctx between them. io.CopyN keeps the
+	// copy_file_range fast path of io.Copy.
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			out.Close()
+			return n, err
+		}
+		c, err := io.CopyN(out, in, copyChunkSize)
+		n += c
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return n, err
+		}
+	}
+	return n, out.Close()
+}
+
+// copyOwner gives path the owner and group recorded in fi. Mkdir and
+// OpenFile apply the umask, so the mode is restored here as well.
+func copyOwner(path string, fi fs.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := os.Lchown(path, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(path, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+}
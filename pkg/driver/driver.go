@@ -7,80 +7,688 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
 const driverName = "demo.csi.example.com"
 
+// stateDirMarkerFile is the sentinel written to stateDir when
+// Options.StateDirMarker is set.
+const stateDirMarkerFile = ".demo-csi-state"
+
+// Options holds the tunable settings of the driver. The zero value disables
+// every optional check.
+type Options struct {
+	// MaxParameters caps the number of entries in CreateVolume parameters and
+	// NodePublishVolume volume context. Zero means unlimited.
+	MaxParameters int
+	// MaxParametersBytes caps the combined size of all keys and values in
+	// those maps. Zero means unlimited.
+	MaxParametersBytes int
+	// RegistrationDir is the kubelet plugin registration directory
+	// (plugins_registry) as seen by this container. When set, New makes
+	// sure it exists with safe permissions before node-driver-registrar
+	// tries to create its socket there.
+	RegistrationDir string
+	// EnableReflection registers the gRPC server reflection service so
+	// tools like grpcurl can list the RPCs. Off by default: it is a debugging
+	// aid and advertises the full API surface to any client.
+	EnableReflection bool
+	// DefaultOpTimeout bounds unary RPCs whose client did not set a
+	// deadline (e.g. grpcurl). Zero disables it.
+	DefaultOpTimeout time.Duration
+	// EmptyCapabilitiesAccessMode is the access mode ValidateVolumeCapabilities
+	// confirms when a request carries no capabilities. UNKNOWN (the default)
+	// rejects such requests with InvalidArgument, as the CSI spec requires.
+	EmptyCapabilitiesAccessMode csi.VolumeCapability_AccessMode_Mode
+	// FSType overrides the detected filesystem type of stateDir (e.g. when
+	// statfs reports an overlay). Empty means detect it at startup.
+	FSType string
+	// StrictUnpublish makes NodeUnpublishVolume check that the mount at the
+	// target path was made from the given volume and reject the call when it
+	// was not, instead of unmounting whatever is there.
+	StrictUnpublish bool
+	// FSGroupPolicy must match the fsGroupPolicy of the CSIDriver object:
+	// FSGroupPolicyFile, FSGroupPolicyReadWriteOnceWithFSType (the Kubernetes
+	// default) or FSGroupPolicyNone. It decides whether the node plugin applies
+	// the pod's fsGroup to the volume.
+	FSGroupPolicy string
+	// StateDirMarker makes New drop a marker file in stateDir and the
+	// RPCs that create directories check for it first, so that a backing
+	// mount that disappears at runtime is reported instead of MkdirAll
+	// silently recreating stateDir on the node's root filesystem.
+	StateDirMarker bool
+	// RejectEscapingSymlinks makes NodePublishVolume scan the volume and
+	// refuse to publish it if it contains a symlink pointing outside of it.
+	// The scan walks the whole tree, so it is opt-in.
+	RejectEscapingSymlinks bool
+	// UnpublishWaitTimeout is how long DeleteVolume waits for an in-flight
+	// NodeUnpublishVolume of the same volume (single-node setups) before
+	// giving up with Aborted.
+	UnpublishWaitTimeout time.Duration
+	// DebugAddr is the host:port of the debug HTTP server, which exposes
+	// the health check results on /debug/health and the published volumes
+	// on /debug/volumes. Empty disables it.
+	DebugAddr string
+	// SlowRPCThreshold is the duration above which an RPC is logged as a
+	// warning regardless of verbosity. Zero disables it.
+	SlowRPCThreshold time.Duration
+	// MountCheck controls the startup probe for bind mount permission
+	// (CAP_SYS_ADMIN): MountCheckOff skips it, MountCheckWarn logs a
+	// warning when mounts are not permitted and MountCheckFail makes New
+	// return an error.
+	MountCheck string
+	// UnmountVerifyRetries is how many times NodeUnpublishVolume re-checks
+	// the mount table after a successful unmount (mount propagation can
+	// make the mount linger briefly). Zero skips the verification.
+	UnmountVerifyRetries int
+	// ReconcileMounts makes Run rebuild the record of published targets
+	// from the mount table at startup; node publish/unpublish RPCs return
+	// Unavailable until that has finished.
+	ReconcileMounts bool
+	// SnapshotDir is where CreateSnapshot stores snapshot copies. Empty
+	// defaults to a "snapshots" directory next to stateDir.
+	SnapshotDir string
+	// EnableQuota allows volumes created with project-quota=true to have
+	// their capacity enforced by an XFS project quota.
+	EnableQuota bool
+	// VolumeStatsTimeout bounds the directory walk NodeGetVolumeStats does
+	// to compute per-volume usage. Zero skips the walk and reports the
+	// usage of the whole backing filesystem.
+	VolumeStatsTimeout time.Duration
+	// ReadOnlyConflict decides what NodePublishVolume does when the mount
+	// flags ask for "rw" but the volume is published read-only:
+	// ReadOnlyConflictReadOnlyWins (the default) mounts it read-only anyway,
+	// ReadOnlyConflictError rejects the call. Either way it is logged.
+	ReadOnlyConflict string
+	// MetricsAddr is the host:port of the Prometheus metrics server, which
+	// serves RPC latency and error metrics on /metrics. Empty disables it.
+	MetricsAddr string
+	// TLSCertFile and TLSKeyFile serve tcp:// endpoints over TLS. They must
+	// be set together; unix socket endpoints ignore them.
+	TLSCertFile string
+	TLSKeyFile  string
+	// MountInfoPath is the mount table the node plugin reads. Empty means
+	// /proc/self/mountinfo; a containerized plugin whose own view is
+	// misleading can point it at e.g. /proc/1/mountinfo of the host.
+	MountInfoPath string
+	// SnapshotSync makes CreateSnapshot flush the source volume's
+	// filesystem before copying and the snapshot's before marking it
+	// complete. Directory volumes cannot be frozen while pods write to
+	// them, so this narrows but does not close the window for an
+	// inconsistent copy.
+	SnapshotSync bool
+	// PublishLeaseTTL enables publish leases: NodeStageVolume records this
+	// node in the metadata of single-node volumes and refuses volumes whose
+	// lease another node renewed within the TTL. Only useful when stateDir
+	// is shared between nodes. Zero disables it.
+	PublishLeaseTTL time.Duration
+	// ConfigFile is a JSON file with the settings that can be changed
+	// without a restart (see reloadableConfig). It is applied by New and
+	// re-read on SIGHUP. Empty means there is none.
+	ConfigFile string
+	// AssumeControllerCreated lets NodeStageVolume create a missing volume
+	// directory, which is right when the controller shares this node's
+	// state dir (single-node clusters). When false a missing directory is
+	// reported as NotFound: on a multi-node cluster it means the volume
+	// lives on another host, and creating it would hand the pod an empty
+	// volume.
+	AssumeControllerCreated bool
+	// MaxVolumesPerNode is reported in NodeGetInfo, so the scheduler does
+	// not place more volumes on the node, and enforced by NodePublishVolume
+	// with ResourceExhausted. Zero means no limit.
+	MaxVolumesPerNode int
+}
+
+// MountCheck values.
+const (
+	MountCheckOff  = "off"
+	MountCheckWarn = "warn"
+	MountCheckFail = "fail"
+)
+
+// ReadOnlyConflict values.
+const (
+	ReadOnlyConflictReadOnlyWins = "readonly-wins"
+	ReadOnlyConflictError        = "error"
+)
+
+// fsGroupPolicy values, named as in the CSIDriver spec.
+const (
+	FSGroupPolicyFile                    = "File"
+	FSGroupPolicyReadWriteOnceWithFSType = "ReadWriteOnceWithFSType"
+	FSGroupPolicyNone                    = "None"
+)
+
 // Driver holds the state for our CSI plugin.
 type Driver struct {
 	nodeID   string
 	stateDir string
+	opts     Options
+
+	// fsType is the filesystem type backing stateDir and fsFeatures what it
+	// supports; both are determined once in New.
+	fsType     string
+	fsFeatures fsFeatures
+
+	// unpublishing tracks NodeUnpublishVolume calls in progress.
+	unpublishing *inflightTracker
+	// volumeLocks serializes the RPCs that modify a volume.
+	volumeLocks *volumeLocks
+	// snapshotLocks is held shared by restores from a snapshot, so that
+	// DeleteSnapshot of that snapshot (and only that one) is refused.
+	snapshotLocks *volumeLocks
+	// published maps target paths to the volume published there.
+	published *publishedTargets
+	// nodeReady is set once published reflects the mounts that existed at
+	// startup.
+	nodeReady atomic.Bool
+
+	// health holds the readiness checks consulted by Probe.
+	health healthChecks
+
+	// quotaMu serializes project ID allocation.
+	quotaMu sync.Mutex
+
+	// metrics is fed by the RPC interceptors and served on MetricsAddr.
+	metrics *rpcMetrics
+
+	// slowRPCThreshold (a time.Duration) and logLevel are the settings
+	// ConfigFile can change at runtime.
+	slowRPCThreshold atomic.Int64
+	logLevel         atomic.Int32
 }
 
 // New creates a new Driver instance.
-func New(nodeID, stateDir string) (*Driver, error) {
+func New(nodeID, stateDir string, opts Options) (*Driver, error) {
+	if opts.MaxParameters < 0 || opts.MaxParametersBytes < 0 {
+		return nil, fmt.Errorf("parameter limits must not be negative")
+	}
+	if opts.UnmountVerifyRetries < 0 {
+		return nil, fmt.Errorf("unmount verify retries must not be negative")
+	}
+	if opts.PublishLeaseTTL < 0 {
+		return nil, fmt.Errorf("publish lease TTL must not be negative")
+	}
+	if opts.MaxVolumesPerNode < 0 {
+		return nil, fmt.Errorf("max volumes per node must not be negative")
+	}
+	if opts.DefaultOpTimeout < 0 {
+		return nil, fmt.Errorf("default operation timeout must not be negative")
+	}
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	switch opts.MountCheck {
+	case "", MountCheckOff, MountCheckWarn, MountCheckFail:
+	default:
+		return nil, fmt.Errorf("unknown mount check mode %q", opts.MountCheck)
+	}
+	switch opts.ReadOnlyConflict {
+	case "":
+		opts.ReadOnlyConflict = ReadOnlyConflictReadOnlyWins
+	case ReadOnlyConflictReadOnlyWins, ReadOnlyConflictError:
+	default:
+		return nil, fmt.Errorf("unknown read-only conflict policy %q", opts.ReadOnlyConflict)
+	}
+	switch opts.FSGroupPolicy {
+	case "":
+		opts.FSGroupPolicy = FSGroupPolicyReadWriteOnceWithFSType
+	case FSGroupPolicyFile, FSGroupPolicyReadWriteOnceWithFSType, FSGroupPolicyNone:
+	default:
+		return nil, fmt.Errorf("unknown fsGroupPolicy %q", opts.FSGroupPolicy)
+	}
+	if m := opts.EmptyCapabilitiesAccessMode; m != csi.VolumeCapability_AccessMode_UNKNOWN && !supportedAccessMode(m) {
+		return nil, fmt.Errorf("unsupported default access mode %s", m)
+	}
+	if opts.MountInfoPath == "" {
+		opts.MountInfoPath = defaultMountInfoPath
+	}
 	if err := os.MkdirAll(stateDir, 0750); err != nil {
 		return nil, fmt.Errorf("failed to create state dir %q: %w", stateDir, err)
 	}
-	return &Driver{nodeID: nodeID, stateDir: stateDir}, nil
+	if opts.SnapshotDir == "" {
+		opts.SnapshotDir = filepath.Join(filepath.Dir(filepath.Clean(stateDir)), "snapshots")
+	}
+	if err := os.MkdirAll(opts.SnapshotDir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot dir %q: %w", opts.SnapshotDir, err)
+	}
+	d := &Driver{
+		nodeID:        nodeID,
+		stateDir:      stateDir,
+		opts:          opts,
+		unpublishing:  newInflightTracker(),
+		volumeLocks:   newVolumeLocks(),
+		snapshotLocks: newVolumeLocks(),
+		published:     newPublishedTargets(opts.MaxVolumesPerNode),
+		metrics:       newRPCMetrics(),
+	}
+	d.nodeReady.Store(!opts.ReconcileMounts)
+	d.slowRPCThreshold.Store(int64(opts.SlowRPCThreshold))
+	d.logLevel.Store(klogVerbosity())
+	if opts.ConfigFile != "" {
+		if err := d.applyConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.StateDirMarker {
+		marker := filepath.Join(stateDir, stateDirMarkerFile)
+		f, err := os.OpenFile(marker, os.O_CREATE|os.O_RDONLY, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create state dir marker %q: %w", marker, err)
+		}
+		f.Close()
+		d.AddHealthCheck("state-dir-marker", d.checkStateDir)
+	}
+	d.AddHealthCheck("state-dir-writable", d.stateDirWritable)
+
+	if opts.MountCheck == MountCheckWarn || opts.MountCheck == MountCheckFail {
+		if err := probeBindMount(stateDir); err != nil {
+			if opts.MountCheck == MountCheckFail {
+				return nil, err
+			}
+			klog.Warningf("%v; NodePublishVolume will fail", err)
+		}
+	}
+
+	d.fsType = opts.FSType
+	if d.fsType == "" {
+		fsType, err := detectFSType(stateDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect filesystem of state dir: %w", err)
+		}
+		d.fsType = fsType
+	}
+	d.fsFeatures = featuresFor(d.fsType)
+	klog.Infof("State dir %s is on %s (%s)", stateDir, d.fsType, d.fsFeatures)
+	if opts.EnableQuota && !d.fsFeatures.projectQuota {
+		klog.Warningf("--enable-quota is set but %s does not support project quotas; quota-enforced volumes will fail", d.fsType)
+	}
+	klog.Infof("fsGroupPolicy: %s", opts.FSGroupPolicy)
+
+	if opts.RegistrationDir != "" {
+		sock, err := prepareRegistrationDir(opts.RegistrationDir)
+		if err != nil {
+			return nil, err
+		}
+		klog.Infof("Kubelet registration socket: %s", sock)
+	}
+	return d, nil
 }
 
-// Run parses the endpoint, starts the gRPC server, and blocks until it stops.
-func (d *Driver) Run(endpoint string) error {
-	u, err := url.Parse(endpoint)
+// prepareRegistrationDir ensures dir exists, is a directory and is not group-
+// or world-writable, and returns the socket path node-driver-registrar creates
+// in it (<dir>/<driverName>-reg.sock).
+func prepareRegistrationDir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("registration dir %q must be an absolute path", dir)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", fmt.Errorf("failed to create registration dir %q: %w", dir, err)
+	}
+	fi, err := os.Stat(dir)
 	if err != nil {
-		return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		return "", fmt.Errorf("failed to stat registration dir %q: %w", dir, err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("registration dir %q is not a directory", dir)
 	}
+	// Anyone who can write here can register a plugin with kubelet.
+	if perm := fi.Mode().Perm(); perm&0022 != 0 {
+		if err := os.Chmod(dir, perm&^0022); err != nil {
+			return "", fmt.Errorf("failed to restrict permissions of registration dir %q: %w", dir, err)
+		}
+		klog.Warningf("Registration dir %q was group/world-writable (%#o), restricted it", dir, perm)
+	}
+	return filepath.Join(dir, driverName+"-reg.sock"), nil
+}
 
-	var addr string
-	switch u.Scheme {
-	case "unix":
-		addr = filepath.Join(u.Host, u.Path)
-		// Remove a stale socket left over from a previous crash.
-		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to remove stale socket %q: %w", addr, err)
+// checkStateDir verifies that the marker written at startup is still present,
+// i.e. that the filesystem backing stateDir has not been unmounted under us.
+func (d *Driver) checkStateDir() error {
+	if !d.opts.StateDirMarker {
+		return nil
+	}
+	marker := filepath.Join(d.stateDir, stateDirMarkerFile)
+	if _, err := os.Stat(marker); err != nil {
+		klog.Errorf("State dir marker %q is missing: %v", marker, err)
+		return status.Errorf(codes.FailedPrecondition, "backing store not mounted: %s is missing", marker)
+	}
+	return nil
+}
+
+// validateID rejects an ID that cannot be used as a single path component
+// under the state or snapshot dir: ".", ".." and anything containing '/'
+// would resolve outside it.
+func validateID(what, id string) error {
+	if id == "." || id == ".." || strings.ContainsRune(id, '/') {
+		return status.Errorf(codes.InvalidArgument, "invalid %s %q", what, id)
+	}
+	return nil
+}
+
+// validateParameters rejects a parameter or context map that exceeds the
+// configured entry count or total size, so that a pathological request cannot
+// make us hold (and persist) an arbitrarily large map.
+func (d *Driver) validateParameters(what string, params map[string]string) error {
+	if d.opts.MaxParameters > 0 && len(params) > d.opts.MaxParameters {
+		return status.Errorf(codes.InvalidArgument, "%s has %d entries, limit is %d",
+			what, len(params), d.opts.MaxParameters)
+	}
+	if d.opts.MaxParametersBytes > 0 {
+		size := 0
+		for k, v := range params {
+			size += len(k) + len(v)
 		}
-		if err := os.MkdirAll(filepath.Dir(addr), 0750); err != nil {
-			return fmt.Errorf("failed to create socket dir: %w", err)
+		if size > d.opts.MaxParametersBytes {
+			return status.Errorf(codes.InvalidArgument, "%s is %d bytes, limit is %d",
+				what, size, d.opts.MaxParametersBytes)
 		}
+	}
+	return nil
+}
+
+// parseEndpoint splits a CSI endpoint into the network and address to
+// listen on. unix://PATH takes an absolute or a relative path (unix://./x.sock
+// is x.sock in the working directory); tcp://HOST:PORT needs a numeric port,
+// and an empty host listens on all interfaces. url.Parse is not used: it
+// splits unix paths between Host and Path.
+func parseEndpoint(endpoint string) (scheme, addr string, err error) {
+	scheme, addr, ok := strings.Cut(endpoint, "://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid endpoint %q: want unix://PATH or tcp://HOST:PORT", endpoint)
+	}
+	switch scheme {
+	case "unix":
+		if addr == "" {
+			return "", "", fmt.Errorf("invalid endpoint %q: empty socket path", endpoint)
+		}
+		return scheme, filepath.Clean(addr), nil
 	case "tcp":
-		addr = u.Host
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid endpoint %q: bad port %q", endpoint, port)
+		}
+		return scheme, net.JoinHostPort(host, port), nil
 	default:
-		return fmt.Errorf("unsupported endpoint scheme %q (use unix:// or tcp://)", u.Scheme)
+		return "", "", fmt.Errorf("unsupported endpoint scheme %q (use unix:// or tcp://)", scheme)
 	}
+}
 
-	listener, err := net.Listen(u.Scheme, addr)
+// Run parses the endpoint, starts the gRPC server, and blocks until it stops.
+// SIGTERM or SIGINT stops the server gracefully, removes the unix socket and
+// makes Run return nil.
+func (d *Driver) Run(endpoint string) error {
+	scheme, addr, err := parseEndpoint(endpoint)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s://%s: %w", u.Scheme, addr, err)
+		return err
 	}
 
-	server := grpc.NewServer(grpc.UnaryInterceptor(logInterceptor))
+	listener, err := d.listen(scheme, addr)
+	if err != nil {
+		return err
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(d.logInterceptor, d.deadlineInterceptor),
+		grpc.ChainStreamInterceptor(d.logStreamInterceptor),
+		grpc.StatsHandler(connStats{m: d.metrics}),
+	}
+	if d.opts.TLSCertFile != "" {
+		if scheme == "tcp" {
+			creds, err := credentials.NewServerTLSFromFile(d.opts.TLSCertFile, d.opts.TLSKeyFile)
+			if err != nil {
+				listener.Close()
+				return fmt.Errorf("failed to load TLS key pair: %w", err)
+			}
+			serverOpts = append(serverOpts, grpc.Creds(creds))
+		} else {
+			klog.V(2).Infof("Ignoring TLS settings for unix socket endpoint")
+		}
+	}
+	server := grpc.NewServer(serverOpts...)
 
 	csi.RegisterIdentityServer(server, &identityServer{d: d})
 	csi.RegisterControllerServer(server, &controllerServer{d: d})
 	csi.RegisterNodeServer(server, &nodeServer{d: d})
+	if d.opts.EnableReflection {
+		reflection.Register(server)
+		klog.Warning("gRPC server reflection is enabled; do not use this in production")
+	}
+
+	if d.opts.DebugAddr != "" {
+		if err := d.startDebugServer(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if d.opts.MetricsAddr != "" {
+		if err := d.startMetricsServer(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if d.opts.ReconcileMounts {
+		go d.reconcilePublished()
+	}
+	if d.opts.PublishLeaseTTL > 0 {
+		go d.renewLeases()
+	}
 
-	klog.Infof("CSI driver listening on %s://%s", u.Scheme, addr)
-	return server.Serve(listener)
+	// Stop on SIGTERM/SIGINT by draining in-flight RPCs rather than dying
+	// mid-mount when the pod is rolled. SIGHUP reloads ConfigFile.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		klog.Infof("CSI driver listening on %s://%s", scheme, addr)
+		serveErr <- server.Serve(listener)
+	}()
+
+	for {
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				d.reloadConfig()
+				continue
+			}
+			klog.Infof("Received %v, shutting down", sig)
+			d.drain(server)
+		}
+		break
+	}
+	if scheme == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("Failed to remove socket %q: %v", addr, err)
+		}
+	}
+	klog.Info("CSI driver stopped")
+	return nil
+}
+
+// drain stops server gracefully, logging the in-flight RPCs and open
+// connections every second until it has, so that a slow termination shows
+// what it is waiting for.
+func (d *Driver) drain(server *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		klog.Infof("Draining: %d in-flight RPC(s), %d open connection(s)", d.metrics.inflight.Load(), d.metrics.conns.Load())
+		select {
+		case <-done:
+			klog.Infof("Drained: %d in-flight RPC(s), %d open connection(s)", d.metrics.inflight.Load(), d.metrics.conns.Load())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startDebugServer serves the debug endpoints on DebugAddr in the background.
+func (d *Driver) startDebugServer() error {
+	listener, err := d.listen("tcp", d.opts.DebugAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/health", d.serveDebugHealth)
+	mux.HandleFunc("/debug/volumes", d.serveDebugVolumes)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			klog.Errorf("Debug server stopped: %v", err)
+		}
+	}()
+	klog.Infof("Debug server listening on %s", d.opts.DebugAddr)
+	return nil
+}
+
+// listen opens a listener for scheme/addr. Every listener the driver opens
+// should go through here so that unix sockets get the same stale-socket
+// cleanup and parent directory creation.
+func (d *Driver) listen(scheme, addr string) (net.Listener, error) {
+	if scheme == "unix" {
+		if err := d.removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(addr), 0750); err != nil {
+			return nil, fmt.Errorf("failed to create socket dir: %w", err)
+		}
+	}
+	listener, err := net.Listen(scheme, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s://%s: %w", scheme, addr, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes a socket left over from a previous crash. It
+// refuses to delete anything that is not a socket, so a mistyped endpoint
+// cannot remove a regular file or directory, and a socket that still accepts
+// connections, which belongs to a running process. Each outcome is counted
+// in csi_stale_socket_cleanups_total.
+func (d *Driver) removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat socket %q: %w", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %q: it exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		d.metrics.staleSockets.WithLabelValues("live").Inc()
+		klog.Errorf("Socket %q is accepting connections, not removing it", path)
+		return fmt.Errorf("socket %q is in use by a running process (another instance of this driver?); stop it or choose a different endpoint", path)
+	}
+	klog.Infof("Socket %q is stale (dial: %v), removing it", path, err)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		d.metrics.staleSockets.WithLabelValues("failed").Inc()
+		return fmt.Errorf("failed to remove stale socket %q: %w", path, err)
+	}
+	d.metrics.staleSockets.WithLabelValues("removed").Inc()
+	return nil
 }
 
 // logInterceptor logs every incoming RPC together with any error that is returned.
-func logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	klog.V(4).Infof("RPC → %s", info.FullMethod)
+// RPCs slower than the slow-RPC threshold are logged as warnings at any verbosity.
+func (d *Driver) logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var resp interface{}
+	err := d.logRPC(info.FullMethod, req, func() error {
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// logStreamInterceptor is logInterceptor for streaming RPCs. The CSI services
+// have none today, but anything registered later gets the same logging.
+func (d *Driver) logStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return d.logRPC(info.FullMethod, nil, func() error {
+		return handler(srv, ss)
+	})
+}
+
+// logRPC runs call, logs it as the RPC method and records it in the metrics;
+// it holds the logic shared by the unary and stream interceptors. The log
+// lines carry structured fields (method, duration, code and, for requests
+// about a volume, volume_id), which --log-format=json emits as JSON keys.
+func (d *Driver) logRPC(method string, req interface{}, call func() error) error {
+	kv := []interface{}{"method", method}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		kv = append(kv, "volume_id", r.GetVolumeId())
+	}
+	klog.V(4).InfoS("RPC started", kv...)
+	d.metrics.inflight.Add(1)
+	defer d.metrics.inflight.Add(-1)
+	start := time.Now()
+	err := call()
+	elapsed := time.Since(start)
+	code := status.Code(err)
+	kv = append(kv, "duration", elapsed, "code", code.String())
+	klog.V(4).InfoS("RPC finished", kv...)
+	d.metrics.observe(method, elapsed, err)
+	if t := time.Duration(d.slowRPCThreshold.Load()); t > 0 && elapsed > t {
+		klog.Warningf("Slow RPC %s took %v (threshold %v)", method, elapsed, t)
+	}
+	if code != codes.OK {
+		klog.ErrorS(err, "RPC failed", kv...)
+	}
+	return err
+}
+
+// deadlineInterceptor derives a context bounded by DefaultOpTimeout when the
+// incoming one has no deadline, so that calls from clients that never set one
+// cannot run forever. Calls that already carry a deadline keep it.
+//
+// Handlers pass ctx to the lock waits, copies and commands that can take
+// long. Those fail in their own way when ctx ends (a killed mkfs, a copy
+// error), so a call that fails after its deadline is reported as
+// DeadlineExceeded (or Canceled), which the sidecars retry.
+func (d *Driver) deadlineInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok && d.opts.DefaultOpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.opts.DefaultOpTimeout)
+		defer cancel()
+	}
 	resp, err := handler(ctx, req)
-	if err != nil {
-		st, _ := status.FromError(err)
-		if st.Code() != codes.OK {
-			klog.Errorf("RPC %s failed: %v", info.FullMethod, err)
+	if err != nil && ctx.Err() != nil {
+		code := status.FromContextError(ctx.Err()).Code()
+		if st := status.Convert(err); st.Code() != code {
+			err = status.Errorf(code, "%s", st.Message())
 		}
 	}
 	return resp, err
@@ -0,0 +1,883 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// newTestDriver returns a Driver whose state and snapshot dirs live in a
+// temporary directory removed when the test ends.
+func newTestDriver(t *testing.T, opts Options) *Driver {
+	t.Helper()
+	d, err := New("test-node", filepath.Join(t.TempDir(), "volumes"), opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d
+}
+
+// createTestVolume creates a 1MiB directory volume named id on d.
+func createTestVolume(t *testing.T, d *Driver, id string) {
+	t.Helper()
+	_, err := (&controllerServer{d: d}).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               id,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume %s: %v", id, err)
+	}
+}
+
+// mountCapability is a single-node-writer filesystem volume capability.
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint   string
+		wantScheme string
+		wantAddr   string
+		wantErr    bool
+	}{
+		{endpoint: "unix:///var/lib/csi/csi.sock", wantScheme: "unix", wantAddr: "/var/lib/csi/csi.sock"},
+		{endpoint: "unix://./csi.sock", wantScheme: "unix", wantAddr: "csi.sock"},
+		{endpoint: "unix://run/csi.sock", wantScheme: "unix", wantAddr: "run/csi.sock"},
+		{endpoint: "unix://", wantErr: true},
+		{endpoint: "tcp://127.0.0.1:10000", wantScheme: "tcp", wantAddr: "127.0.0.1:10000"},
+		{endpoint: "tcp://:10000", wantScheme: "tcp", wantAddr: ":10000"},
+		{endpoint: "tcp://[::1]:9", wantScheme: "tcp", wantAddr: "[::1]:9"},
+		{endpoint: "tcp://localhost", wantErr: true},
+		{endpoint: "tcp://localhost:99999", wantErr: true},
+		{endpoint: "tcp://localhost:1/x", wantErr: true},
+		{endpoint: "http://localhost:80", wantErr: true},
+		{endpoint: "/var/lib/csi/csi.sock", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			scheme, addr, err := parseEndpoint(tt.endpoint)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseEndpoint(%q) = %q, %q, want an error", tt.endpoint, scheme, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEndpoint(%q): %v", tt.endpoint, err)
+			}
+			if scheme != tt.wantScheme || addr != tt.wantAddr {
+				t.Errorf("parseEndpoint(%q) = %q, %q, want %q, %q", tt.endpoint, scheme, addr, tt.wantScheme, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestOversizedParametersRejected(t *testing.T) {
+	d := newTestDriver(t, Options{MaxParameters: 2, MaxParametersBytes: 64})
+	tooMany := map[string]string{"a": "1", "b": "2", "c": "3"}
+	tooLarge := map[string]string{"a": strings.Repeat("x", 64)}
+
+	for name, params := range map[string]map[string]string{"entries": tooMany, "bytes": tooLarge} {
+		t.Run("CreateVolume/"+name, func(t *testing.T) {
+			cs := &controllerServer{d: d}
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol-" + name,
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+				Parameters:         params,
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("CreateVolume: got %v, want InvalidArgument", err)
+			}
+		})
+		t.Run("NodePublishVolume/"+name, func(t *testing.T) {
+			ns := &nodeServer{d: d}
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-" + name,
+				StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+				TargetPath:        filepath.Join(t.TempDir(), "target"),
+				VolumeCapability:  mountCapability(),
+				VolumeContext:     params,
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("NodePublishVolume: got %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestValidateID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "pvc-0123", wantErr: false},
+		{id: "vol.1", wantErr: false},
+		{id: "..vol", wantErr: false},
+		{id: ".", wantErr: true},
+		{id: "..", wantErr: true},
+		{id: "../x", wantErr: true},
+		{id: "a/b", wantErr: true},
+		{id: "/etc", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validateID("volume ID", tt.id)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateID(%q) = %v, want error %t", tt.id, err, tt.wantErr)
+		}
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("validateID(%q) = %v, want InvalidArgument", tt.id, err)
+		}
+	}
+}
+
+// TestVolumeIDValidated checks that every RPC taking a volume ID rejects one
+// that would resolve outside the state dir.
+func TestVolumeIDValidated(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs, ns := &controllerServer{d: d}, &nodeServer{d: d}
+	ctx := context.Background()
+	dir := t.TempDir()
+	staging, target := filepath.Join(dir, "staging"), filepath.Join(dir, "target")
+	caps := []*csi.VolumeCapability{mountCapability()}
+
+	rpcs := map[string]func(id string) error{
+		"CreateVolume": func(id string) error {
+			_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: id, VolumeCapabilities: caps})
+			return err
+		},
+		"DeleteVolume": func(id string) error {
+			_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+			return err
+		},
+		"ValidateVolumeCapabilities": func(id string) error {
+			_, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: id, VolumeCapabilities: caps})
+			return err
+		},
+		"ControllerExpandVolume": func(id string) error {
+			_, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: id, CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 20}})
+			return err
+		},
+		"ControllerGetVolume": func(id string) error {
+			_, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: id})
+			return err
+		},
+		"NodeStageVolume": func(id string) error {
+			_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: id, StagingTargetPath: staging, VolumeCapability: caps[0]})
+			return err
+		},
+		"NodeUnstageVolume": func(id string) error {
+			_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: staging})
+			return err
+		},
+		"NodePublishVolume": func(id string) error {
+			_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: id, StagingTargetPath: staging, TargetPath: target, VolumeCapability: caps[0]})
+			return err
+		},
+		"NodeUnpublishVolume": func(id string) error {
+			_, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: id, TargetPath: target})
+			return err
+		},
+		"NodeGetVolumeStats": func(id string) error {
+			_, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: id, VolumePath: target})
+			return err
+		},
+		"NodeExpandVolume": func(id string) error {
+			_, err := ns.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: id, VolumePath: target})
+			return err
+		},
+	}
+	for name, call := range rpcs {
+		for _, id := range []string{"..", "../escaped", "a/b"} {
+			if err := call(id); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s(%q): got %v, want InvalidArgument", name, id, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "..", "escaped")); !os.IsNotExist(err) {
+		t.Errorf("a volume was created outside the state dir: %v", err)
+	}
+}
+
+func TestPrepareRegistrationDir(t *testing.T) {
+	t.Run("created", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "plugins_registry")
+		sock, err := prepareRegistrationDir(dir)
+		if err != nil {
+			t.Fatalf("prepareRegistrationDir: %v", err)
+		}
+		if want := filepath.Join(dir, driverName+"-reg.sock"); sock != want {
+			t.Errorf("socket = %q, want %q", sock, want)
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Errorf("registration dir not created: %v", err)
+		}
+	})
+	t.Run("writable restricted", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := prepareRegistrationDir(dir); err != nil {
+			t.Fatalf("prepareRegistrationDir: %v", err)
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0755 {
+			t.Errorf("permissions = %#o, want 0755", perm)
+		}
+	})
+	t.Run("relative", func(t *testing.T) {
+		if _, err := prepareRegistrationDir("plugins_registry"); err == nil {
+			t.Error("prepareRegistrationDir accepted a relative path")
+		}
+	})
+	t.Run("not a directory", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(file, nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := prepareRegistrationDir(file); err == nil {
+			t.Error("prepareRegistrationDir accepted a regular file")
+		}
+	})
+	t.Run("via New", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "plugins_registry")
+		newTestDriver(t, Options{RegistrationDir: dir})
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("New did not prepare the registration dir: %v", err)
+		}
+	})
+}
+
+// TestRunClosesListenerOnStartupError checks that Run does not leave the CSI
+// socket behind when a side server fails to start.
+func TestRunClosesListenerOnStartupError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	for name, opts := range map[string]Options{
+		"debug":   {DebugAddr: busy.Addr().String()},
+		"metrics": {MetricsAddr: busy.Addr().String()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := newTestDriver(t, opts)
+			sock := filepath.Join(t.TempDir(), "csi.sock")
+			if err := d.Run("unix://" + sock); err == nil {
+				t.Fatal("Run succeeded although its address is in use")
+			}
+			if _, err := os.Stat(sock); !os.IsNotExist(err) {
+				t.Errorf("socket %s left behind: %v", sock, err)
+			}
+		})
+	}
+}
+
+func TestDeadlineInterceptorDefaultTimeout(t *testing.T) {
+	d := newTestDriver(t, Options{DefaultOpTimeout: 50 * time.Millisecond})
+	slow := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.Error(codes.Internal, "copy interrupted")
+	}
+
+	start := time.Now()
+	_, err := d.deadlineInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, slow)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("slow call without a deadline: got %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("slow call was cancelled after %v, want about 50ms", elapsed)
+	}
+
+	// A deadline set by the client is kept as it is.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	_, err = d.deadlineInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		if got, ok := ctx.Deadline(); !ok || !got.Equal(want) {
+			t.Errorf("handler deadline = %v, %t, want the client's %v", got, ok, want)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Errorf("call with a client deadline: %v", err)
+	}
+}
+
+func TestDeadlineInterceptorKeepsContextCode(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	failAfterCtx := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.Error(codes.Internal, "mkfs: signal: killed")
+	}
+	expired, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := map[string]struct {
+		ctx  context.Context
+		want codes.Code
+	}{
+		"deadline": {ctx: expired, want: codes.DeadlineExceeded},
+		"canceled": {ctx: canceled, want: codes.Canceled},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := d.deadlineInterceptor(tt.ctx, nil, &grpc.UnaryServerInfo{}, failAfterCtx)
+			if status.Code(err) != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(status.Convert(err).Message(), "mkfs") {
+				t.Errorf("message %q lost the handler's error", status.Convert(err).Message())
+			}
+		})
+	}
+
+	// Errors returned while the context is live are untouched.
+	_, err := d.deadlineInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Internal, "boom")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("live context: got %v, want Internal", err)
+	}
+}
+
+// runTestDriver runs d on endpoint until the test ends and returns a client
+// connected to target, the address a CO would dial for it. Like a pod, the
+// server is stopped with SIGTERM.
+func runTestDriver(t *testing.T, d *Driver, endpoint, target string, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- d.Run(endpoint) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.DialContext(ctx, target, append(dialOpts, grpc.WithBlock())...)
+	if err != nil {
+		select {
+		case err := <-done:
+			t.Fatalf("Run: %v", err)
+		default:
+		}
+		// Run may not handle signals yet; leave it rather than kill the test.
+		t.Fatalf("dial %s: %v", target, err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Errorf("SIGTERM: %v", err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Error("Run did not return after SIGTERM")
+		}
+	})
+	return conn
+}
+
+// freeTCPAddr returns a loopback address nothing listens on.
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key,
+// and returns their paths and a pool that trusts the certificate.
+func writeTestCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "demo-csi-plugin test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestRunTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	d := newTestDriver(t, Options{TLSCertFile: certFile, TLSKeyFile: keyFile})
+	addr := freeTCPAddr(t)
+	conn := runTestDriver(t, d, "tcp://"+addr, addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool})))
+
+	resp, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Probe over TLS: %v", err)
+	}
+	if !resp.GetReady().GetValue() {
+		t.Error("Probe over TLS reported not ready")
+	}
+
+	// A plaintext client cannot talk to the TLS endpoint.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	plain, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := csi.NewIdentityClient(plain).Probe(ctx, &csi.ProbeRequest{}); err == nil {
+		t.Error("plaintext Probe against the TLS endpoint succeeded")
+	}
+}
+
+func TestNewRejectsHalfTLSConfig(t *testing.T) {
+	certFile, keyFile, _ := writeTestCert(t)
+	for name, opts := range map[string]Options{
+		"certificate only": {TLSCertFile: certFile},
+		"key only":         {TLSKeyFile: keyFile},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New("test-node", filepath.Join(t.TempDir(), "volumes"), opts); err == nil {
+				t.Error("New accepted half a TLS configuration")
+			}
+		})
+	}
+}
+
+// TestReflection checks that reflection lists the CSI services only when it
+// is enabled.
+func TestReflection(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			d := newTestDriver(t, Options{EnableReflection: enabled})
+			sock := filepath.Join(t.TempDir(), "csi.sock")
+			conn := runTestDriver(t, d, "unix://"+sock, "unix://"+sock)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			services, err := listServices(ctx, conn)
+			if !enabled {
+				if status.Code(err) != codes.Unimplemented {
+					t.Errorf("reflection while disabled: got %v, %v, want Unimplemented", services, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reflection: %v", err)
+			}
+			for _, want := range []string{"csi.v1.Identity", "csi.v1.Controller", "csi.v1.Node"} {
+				if !slices.Contains(services, want) {
+					t.Errorf("reflection lists %v, want %s among them", services, want)
+				}
+			}
+		})
+	}
+}
+
+// listServices asks the reflection service of conn for the services it serves.
+func listServices(ctx context.Context, conn *grpc.ClientConn) ([]string, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		names = append(names, s.GetName())
+	}
+	return names, nil
+}
+
+// staleSocket leaves a socket at path that nothing listens on, as a killed
+// driver does.
+func staleSocket(t *testing.T, path string) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+}
+
+func TestListenRemovesStaleSockets(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "csi.sock"), filepath.Join(dir, "debug.sock"), filepath.Join(dir, "metrics.sock")}
+	for _, p := range paths {
+		staleSocket(t, p)
+	}
+	for _, p := range paths {
+		l, err := d.listen("unix", p)
+		if err != nil {
+			t.Fatalf("listen on stale %s: %v", p, err)
+		}
+		defer l.Close()
+		conn, err := net.Dial("unix", p)
+		if err != nil {
+			t.Errorf("%s is not bound again: %v", p, err)
+			continue
+		}
+		conn.Close()
+	}
+	if got := testutil.ToFloat64(d.metrics.staleSockets.WithLabelValues("removed")); got != float64(len(paths)) {
+		t.Errorf("removed stale sockets counted %v times, want %d", got, len(paths))
+	}
+
+	// Anything that is not a socket is left alone.
+	file := filepath.Join(dir, "not-a-socket")
+	if err := os.WriteFile(file, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.listen("unix", file); err == nil {
+		t.Error("listen replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestListenKeepsLiveSocket(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	sock := filepath.Join(t.TempDir(), "csi.sock")
+	// Another instance serving the socket.
+	live, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	go func() {
+		for {
+			conn, err := live.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, err = d.listen("unix", sock)
+	if err == nil || !strings.Contains(err.Error(), "in use by a running process") {
+		t.Fatalf("listen on a live socket: got %v, want an in-use error", err)
+	}
+	if got := testutil.ToFloat64(d.metrics.staleSockets.WithLabelValues("live")); got != 1 {
+		t.Errorf("live sockets counted %v times, want 1", got)
+	}
+	if got := testutil.ToFloat64(d.metrics.staleSockets.WithLabelValues("removed")); got != 0 {
+		t.Errorf("removed sockets counted %v times, want 0", got)
+	}
+	// The other instance keeps serving.
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("live socket no longer served: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRunRebindsStaleSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "csi.sock")
+	staleSocket(t, sock)
+	conn := runTestDriver(t, newTestDriver(t, Options{}), "unix://"+sock, "unix://"+sock)
+	if _, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe on the re-bound socket: %v", err)
+	}
+}
+
+// TestStateDirMarkerMissing simulates the state dir's filesystem vanishing
+// from under a running driver, which leaves an empty mount point behind.
+func TestStateDirMarkerMissing(t *testing.T) {
+	d := newTestDriver(t, Options{StateDirMarker: true})
+	createTestVolume(t, d, "vol-1")
+	ctx := context.Background()
+	probe := func() bool {
+		resp, err := (&identityServer{d: d}).Probe(ctx, &csi.ProbeRequest{})
+		if err != nil {
+			t.Fatalf("Probe: %v", err)
+		}
+		return resp.GetReady().GetValue()
+	}
+	if !probe() {
+		t.Fatal("Probe not ready with the marker in place")
+	}
+
+	if err := os.Remove(filepath.Join(d.stateDir, stateDirMarkerFile)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := (&controllerServer{d: d}).CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-2",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CreateVolume without the marker: got %v, want FailedPrecondition", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-2")); !os.IsNotExist(err) {
+		t.Errorf("CreateVolume without the marker created the volume: %v", err)
+	}
+	_, err = (&nodeServer{d: d}).NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability:  mountCapability(),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("NodeStageVolume without the marker: got %v, want FailedPrecondition", err)
+	}
+	if probe() {
+		t.Error("Probe ready without the marker")
+	}
+}
+
+// captureKlog sends klog's text output to the returned buffer until the test
+// ends.
+func captureKlog(t *testing.T) *syncBuffer {
+	t.Helper()
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	if err := flags.Set("logtostderr", "false"); err != nil {
+		t.Fatal(err)
+	}
+	buf := &syncBuffer{}
+	klog.SetOutput(buf)
+	t.Cleanup(func() {
+		klog.Flush()
+		flags.Set("logtostderr", "true")
+		klog.SetOutput(os.Stderr)
+	})
+	return buf
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSlowRPCWarning(t *testing.T) {
+	logs := captureKlog(t)
+	d := newTestDriver(t, Options{SlowRPCThreshold: 20 * time.Millisecond})
+	call := func(method string, took time.Duration) {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := d.logInterceptor(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			time.Sleep(took)
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+	}
+
+	call("/csi.v1.Node/NodeGetInfo", 0)
+	call("/csi.v1.Controller/CreateVolume", 50*time.Millisecond)
+	klog.Flush()
+
+	out := logs.String()
+	if !strings.Contains(out, "Slow RPC /csi.v1.Controller/CreateVolume") {
+		t.Errorf("no slow-RPC warning for the slow call in:\n%s", out)
+	}
+	if strings.Contains(out, "Slow RPC /csi.v1.Node/NodeGetInfo") {
+		t.Errorf("slow-RPC warning for a fast call in:\n%s", out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "Slow RPC") && !strings.HasPrefix(line, "W") {
+			t.Errorf("slow-RPC line is not a warning: %s", line)
+		}
+	}
+}
+
+func TestConfigReloadOnSIGHUP(t *testing.T) {
+	logs := captureKlog(t)
+	origLevel := klogVerbosity()
+	t.Cleanup(func() {
+		var level klog.Level
+		level.Set(fmt.Sprint(origLevel))
+	})
+	config := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(config, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"slowRPCThreshold": "1s"}`)
+	d := newTestDriver(t, Options{ConfigFile: config})
+	if got := time.Duration(d.slowRPCThreshold.Load()); got != time.Second {
+		t.Fatalf("slowRPCThreshold at startup = %v, want 1s", got)
+	}
+	sock := filepath.Join(t.TempDir(), "csi.sock")
+	runTestDriver(t, d, "unix://"+sock, "unix://"+sock)
+	// hup signals Run and waits for it to log the outcome of the reload.
+	hup := func(outcome string) {
+		t.Helper()
+		seen := strings.Count(logs.String(), outcome)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("SIGHUP: %v", err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); strings.Count(logs.String(), outcome) == seen; {
+			if time.Now().After(deadline) {
+				t.Fatalf("no %q logged after SIGHUP in:\n%s", outcome, logs.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	writeConfig(`{"slowRPCThreshold": "250ms", "logLevel": 3}`)
+	hup("Config: logLevel")
+	if got := time.Duration(d.slowRPCThreshold.Load()); got != 250*time.Millisecond {
+		t.Errorf("slowRPCThreshold after reload = %v, want 250ms", got)
+	}
+	if got := klogVerbosity(); got != 3 {
+		t.Errorf("log level after reload = %d, want 3", got)
+	}
+	if !strings.Contains(logs.String(), "Config: slowRPCThreshold 1s -> 250ms") {
+		t.Errorf("threshold change not logged in:\n%s", logs.String())
+	}
+
+	// Structural settings are not reloadable, and a file naming one is
+	// rejected as a whole.
+	writeConfig(`{"slowRPCThreshold": "5s", "endpoint": "unix:///tmp/other.sock"}`)
+	hup("Config reload failed")
+	if !strings.Contains(logs.String(), `unknown field "endpoint"`) {
+		t.Errorf("unknown key not reported in:\n%s", logs.String())
+	}
+	if got := time.Duration(d.slowRPCThreshold.Load()); got != 250*time.Millisecond {
+		t.Errorf("slowRPCThreshold after a rejected reload = %v, want 250ms", got)
+	}
+}
+
+func TestJSONLogFields(t *testing.T) {
+	// The same logger --log-format=json installs.
+	logs := &syncBuffer{}
+	klog.SetLogger(funcr.NewJSON(func(obj string) {
+		fmt.Fprintln(logs, obj)
+	}, funcr.Options{Verbosity: 128}))
+	t.Cleanup(klog.ClearLogger)
+
+	d := newTestDriver(t, Options{})
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeGetVolumeStats"}
+	_, err := d.logInterceptor(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1"}, info,
+		func(context.Context, interface{}) (interface{}, error) {
+			return nil, status.Error(codes.NotFound, "volume vol-1 not found")
+		})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("logInterceptor: got %v, want NotFound", err)
+	}
+	klog.Flush()
+
+	var line map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q: %v", l, err)
+		}
+		if entry["msg"] == "RPC failed" {
+			line = entry
+		}
+	}
+	if line == nil {
+		t.Fatalf("no RPC failed line in:\n%s", logs.String())
+	}
+	for key, want := range map[string]string{
+		"method":    info.FullMethod,
+		"volume_id": "vol-1",
+		"code":      "NotFound",
+	} {
+		if line[key] != want {
+			t.Errorf("%s = %v, want %q", key, line[key], want)
+		}
+	}
+	if _, ok := line["duration"]; !ok {
+		t.Errorf("no duration field in %v", line)
+	}
+}
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// volumeContextEphemeral is set to "true" by kubelet for CSI ephemeral inline
+// volumes, which have no CreateVolume or NodeStageVolume call: the node
+// creates the volume at publish and deletes it at unpublish.
+const volumeContextEphemeral = "csi.storage.k8s.io/ephemeral"
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[volumeContextEphemeral] == "true"
+}
+
+// publishEphemeral creates the directory of an inline volume on first use
+// and bind-mounts it at the target path. The metadata marks it ephemeral so
+// that NodeUnpublishVolume knows to delete it.
+func (s *nodeServer) publishEphemeral(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	id := req.GetVolumeId()
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral volumes support mount access only")
+	}
+	if err := s.d.checkStateDir(); err != nil {
+		return nil, err
+	}
+	volumeDir := filepath.Join(s.d.stateDir, id)
+	targetPath := req.GetTargetPath()
+
+	meta, err := s.d.loadMeta(id)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(volumeDir, 0750); err != nil {
+			return nil, fsError(err, "failed to create volume dir %q", volumeDir)
+		}
+		if gid, ok, err := s.mountGroup(req.GetVolumeCapability()); err != nil {
+			return nil, err
+		} else if ok {
+			if err := applyGroup(volumeDir, gid); err != nil {
+				return nil, fsError(err, "failed to apply fsGroup %d to %q", gid, volumeDir)
+			}
+		}
+		meta = &volumeMeta{CreationTime: time.Now().UTC(), Ephemeral: true}
+		if err := s.d.saveMeta(id, meta); err != nil {
+			return nil, fsError(err, "failed to write metadata for volume %s", id)
+		}
+		klog.Infof("NodePublishVolume: created ephemeral volume %s at %s", id, volumeDir)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", id, err)
+	case !meta.Ephemeral:
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s exists and is not ephemeral", id)
+	}
+
+	if err := ensureTarget(targetPath, true); err != nil {
+		return nil, err
+	}
+	if err := s.d.published.claim(targetPath, id); err != nil {
+		return nil, err
+	}
+	mounts, err := readMountInfo(s.d.opts.MountInfoPath)
+	if err != nil {
+		s.d.published.release(targetPath)
+		return nil, status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+	}
+	if isBindOf(mounts, targetPath, volumeDir) {
+		klog.V(4).Infof("NodePublishVolume: %q is already published at %q", volumeDir, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	readOnly, err := s.publishReadOnly(req)
+	if err != nil {
+		s.d.published.release(targetPath)
+		return nil, err
+	}
+	flags := mountFlags(req.GetVolumeCapability().GetMount().GetMountFlags())
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := bindMount(volumeDir, targetPath, flags); err != nil {
+		s.d.published.release(targetPath)
+		return nil, err
+	}
+
+	klog.Infof("NodePublishVolume: id=%s ephemeral target=%s", id, targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// removeEphemeral deletes volumeID if it is an ephemeral volume. Other
+// volumes are left alone.
+func (d *Driver) removeEphemeral(volumeID string) error {
+	meta, err := d.loadMeta(volumeID)
+	if err != nil || !meta.Ephemeral {
+		return nil
+	}
+	volumeDir := filepath.Join(d.stateDir, volumeID)
+	if err := os.RemoveAll(volumeDir); err != nil {
+		return fsError(err, "failed to delete ephemeral volume dir %q", volumeDir)
+	}
+	klog.Infof("NodeUnpublishVolume: deleted ephemeral volume %s", volumeID)
+	return nil
+}
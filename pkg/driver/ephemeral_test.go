@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEphemeralVolumeLifecycle(t *testing.T) {
+	requireMounts(t)
+	d := newTestDriver(t, Options{})
+	ns := &nodeServer{d: d}
+	ctx := context.Background()
+	target := filepath.Join(t.TempDir(), "target")
+	t.Cleanup(func() { syscall.Unmount(target, syscall.MNT_DETACH) })
+	publish := func(id string) error {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         id,
+			TargetPath:       target,
+			VolumeCapability: mountCapability(),
+			VolumeContext:    map[string]string{volumeContextEphemeral: "true"},
+		})
+		return err
+	}
+	volumeDir := filepath.Join(d.stateDir, "csi-0123")
+
+	if err := publish("csi-0123"); err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	// What the pod writes lands in the backing directory.
+	if err := os.WriteFile(filepath.Join(target, "data"), []byte("hello"), 0640); err != nil {
+		t.Fatalf("write through the target: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(volumeDir, "data")); err != nil {
+		t.Errorf("pod data not in the backing directory: %v", err)
+	}
+	if err := publish("csi-0123"); err != nil {
+		t.Errorf("repeated NodePublishVolume: %v", err)
+	}
+
+	unpublish := &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-0123", TargetPath: target}
+	if _, err := ns.NodeUnpublishVolume(ctx, unpublish); err != nil {
+		t.Fatalf("NodeUnpublishVolume: %v", err)
+	}
+	if _, err := os.Stat(volumeDir); !os.IsNotExist(err) {
+		t.Errorf("backing directory after NodeUnpublishVolume: %v, want it removed", err)
+	}
+	if _, err := ns.NodeUnpublishVolume(ctx, unpublish); err != nil {
+		t.Errorf("repeated NodeUnpublishVolume: %v", err)
+	}
+
+	// A provisioned volume is not taken over by an inline one of that name.
+	createTestVolume(t, d, "vol-1")
+	if err := publish("vol-1"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("ephemeral publish of a provisioned volume: got %v, want AlreadyExists", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-1")); err != nil {
+		t.Errorf("provisioned volume after the refused publish: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fsError wraps a filesystem or mount error in a gRPC status whose code tells
+// the sidecars whether retrying makes sense. The message is built from format
+// and args, followed by the underlying error.
+func fsError(err error, format string, args ...interface{}) error {
+	return status.Errorf(fsErrorCode(err), "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
+// fsErrorCode classifies err by its errno. Transient conditions map to
+// Unavailable/Aborted, which the sidecars retry with backoff; conditions that
+// will not change on retry map to the matching permanent code. Anything we do
+// not recognise stays Internal.
+func fsErrorCode(err error) codes.Code {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return codes.Internal
+	}
+	switch errno {
+	case syscall.EAGAIN, syscall.EINTR:
+		return codes.Unavailable
+	case syscall.EBUSY:
+		// Usually another operation (or a pod) still holds the path.
+		return codes.Aborted
+	case syscall.ENOENT:
+		return codes.NotFound
+	case syscall.ENAMETOOLONG, syscall.ENOTDIR:
+		return codes.InvalidArgument
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFSErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{name: "EAGAIN", err: syscall.EAGAIN, want: codes.Unavailable},
+		{name: "EINTR", err: syscall.EINTR, want: codes.Unavailable},
+		{name: "EBUSY", err: syscall.EBUSY, want: codes.Aborted},
+		{name: "ENOENT", err: syscall.ENOENT, want: codes.NotFound},
+		{name: "ENAMETOOLONG", err: syscall.ENAMETOOLONG, want: codes.InvalidArgument},
+		{name: "ENOTDIR", err: syscall.ENOTDIR, want: codes.InvalidArgument},
+		{name: "ENOSPC", err: syscall.ENOSPC, want: codes.ResourceExhausted},
+		{name: "EDQUOT", err: syscall.EDQUOT, want: codes.ResourceExhausted},
+		{name: "other errno", err: syscall.EPERM, want: codes.Internal},
+		{name: "no errno", err: errors.New("boom"), want: codes.Internal},
+		{name: "PathError", err: &os.PathError{Op: "mkdir", Path: "/x", Err: syscall.ENOSPC}, want: codes.ResourceExhausted},
+		{name: "wrapped", err: fmt.Errorf("stage: %w", &os.PathError{Op: "open", Path: "/x", Err: syscall.ENOENT}), want: codes.NotFound},
+		{name: "SyscallError", err: os.NewSyscallError("mount", syscall.EBUSY), want: codes.Aborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fsErrorCode(tt.err); got != tt.want {
+				t.Errorf("fsErrorCode(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+			if got := status.Code(fsError(tt.err, "op on %q", "/x")); got != tt.want {
+				t.Errorf("fsError(%v) has code %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
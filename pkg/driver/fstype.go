@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Filesystem magic numbers as reported in statfs(2) f_type.
+var fsMagic = map[int64]string{
+	0xEF53:     "ext4", // shared by ext2/ext3/ext4
+	0x58465342: "xfs",
+	0x9123683E: "btrfs",
+	0x2FC12FC2: "zfs",
+	0xF2F52010: "f2fs",
+	0x01021994: "tmpfs",
+	0x794C7630: "overlay",
+	0x6969:     "nfs",
+}
+
+// fsFeatures records which optional behaviours the backing filesystem of
+// stateDir supports.
+type fsFeatures struct {
+	// projectQuota is true where we can enforce volume capacity with
+	// per-directory project quotas (via xfs_quota).
+	projectQuota bool
+}
+
+func (f fsFeatures) String() string {
+	return fmt.Sprintf("projectQuota=%t", f.projectQuota)
+}
+
+// featuresFor returns the features available on a filesystem of type fsType.
+func featuresFor(fsType string) fsFeatures {
+	if fsType == "xfs" {
+		return fsFeatures{projectQuota: true}
+	}
+	return fsFeatures{}
+}
+
+// detectFSType returns the filesystem type of path, or "unknown" followed by
+// the raw magic number when it is not one we recognise.
+func detectFSType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", fmt.Errorf("statfs %q: %w", path, err)
+	}
+	if name, ok := fsMagic[int64(st.Type)]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("unknown(%#x)", st.Type), nil
+}
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDetectFSType(t *testing.T) {
+	fsType, err := detectFSType(t.TempDir())
+	if err != nil {
+		t.Fatalf("detectFSType: %v", err)
+	}
+	if fsType == "" {
+		t.Error("detectFSType returned an empty type")
+	}
+	if _, err := detectFSType("/no/such/dir"); err == nil {
+		t.Error("detectFSType of a missing dir succeeded")
+	}
+}
+
+// TestFSTypeGatesQuota stubs the filesystem type of the state dir and checks
+// that project quotas are offered only where the filesystem supports them.
+func TestFSTypeGatesQuota(t *testing.T) {
+	old := xfsQuotaCommand
+	xfsQuotaCommand = "true"
+	t.Cleanup(func() { xfsQuotaCommand = old })
+
+	tests := []struct {
+		fsType   string
+		wantCode codes.Code
+	}{
+		{fsType: "xfs", wantCode: codes.OK},
+		{fsType: "ext4", wantCode: codes.ResourceExhausted},
+		{fsType: "tmpfs", wantCode: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fsType, func(t *testing.T) {
+			d := newTestDriver(t, Options{EnableQuota: true, FSType: tt.fsType})
+			if d.fsType != tt.fsType {
+				t.Errorf("fsType = %q, want the configured %q", d.fsType, tt.fsType)
+			}
+			if want := tt.wantCode == codes.OK; d.fsFeatures.projectQuota != want {
+				t.Errorf("%s: projectQuota = %t, want %t", tt.fsType, d.fsFeatures.projectQuota, want)
+			}
+			_, err := (&controllerServer{d: d}).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+				Parameters:         map[string]string{paramProjectQuota: "true"},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("quota-enforced CreateVolume on %s: got %v, want %v", tt.fsType, err, tt.wantCode)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.fsType) {
+				t.Errorf("error %q does not name the filesystem", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// healthCheck is one readiness condition consulted by Probe.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// checkResult is the outcome of a single health check, as shown on the debug
+// endpoint.
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthChecks is the set of registered checks.
+type healthChecks struct {
+	mu     sync.Mutex
+	checks []healthCheck
+	// writeProbing is set while stateDirWritable's probe runs.
+	writeProbing atomic.Bool
+}
+
+// AddHealthCheck registers a readiness check. Probe reports not-ready while
+// any registered check returns an error.
+func (d *Driver) AddHealthCheck(name string, check func() error) {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+	d.health.checks = append(d.health.checks, healthCheck{name: name, check: check})
+}
+
+// runHealthChecks runs every registered check and reports whether all passed.
+// Failures are logged with the name of the check.
+func (d *Driver) runHealthChecks() ([]checkResult, bool) {
+	d.health.mu.Lock()
+	checks := append([]healthCheck(nil), d.health.checks...)
+	d.health.mu.Unlock()
+
+	results := make([]checkResult, 0, len(checks))
+	ready := true
+	for _, c := range checks {
+		r := checkResult{Name: c.name, OK: true}
+		if err := c.check(); err != nil {
+			klog.Errorf("Health check %q failed: %v", c.name, err)
+			r.OK = false
+			r.Error = err.Error()
+			ready = false
+		}
+		results = append(results, r)
+	}
+	return results, ready
+}
+
+// stateDirProbeTimeout bounds stateDirWritable, so that a hung state dir
+// (e.g. an unreachable network filesystem) fails Probe instead of blocking it.
+const stateDirProbeTimeout = 500 * time.Millisecond
+
+// stateDirWritable checks that a file can be created and removed in stateDir
+// within stateDirProbeTimeout. A write that is still blocked fails the check
+// without starting another one.
+func (d *Driver) stateDirWritable() error {
+	if !d.health.writeProbing.CompareAndSwap(false, true) {
+		return errors.New("previous write probe of the state dir is still blocked")
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer d.health.writeProbing.Store(false)
+		done <- d.writeProbe()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(stateDirProbeTimeout):
+		return fmt.Errorf("write probe of the state dir took longer than %v", stateDirProbeTimeout)
+	}
+}
+
+// writeProbe creates and removes a file in stateDir.
+func (d *Driver) writeProbe() error {
+	f, err := os.CreateTemp(d.stateDir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// serveDebugHealth writes the result of every health check as JSON.
+func (d *Driver) serveDebugHealth(w http.ResponseWriter, _ *http.Request) {
+	results, ready := d.runHealthChecks()
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		klog.Errorf("Failed to write health check results: %v", err)
+	}
+}
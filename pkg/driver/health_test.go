@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestProbeFailingCheck(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	ids := &identityServer{d: d}
+
+	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if !resp.GetReady().GetValue() {
+		t.Fatal("Probe reports not ready with only the built-in checks")
+	}
+
+	d.AddHealthCheck("backend-reachable", func() error { return errors.New("connection refused") })
+	resp, err = ids.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if resp.GetReady().GetValue() {
+		t.Error("Probe reports ready although a check fails")
+	}
+
+	rec := httptest.NewRecorder()
+	d.serveDebugHealth(rec, httptest.NewRequest(http.MethodGet, "/debug/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/debug/health status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `"name":"backend-reachable","ok":false,"error":"connection refused"`) {
+		t.Errorf("/debug/health does not name the failing check: %s", body)
+	}
+	if !strings.Contains(body, `"name":"state-dir-writable","ok":true`) {
+		t.Errorf("/debug/health does not list the passing check: %s", body)
+	}
+}
+
+func TestProbeStateDir(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	ids := &identityServer{d: d}
+	ready := func() bool {
+		t.Helper()
+		resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+		if err != nil {
+			t.Fatalf("Probe: %v", err)
+		}
+		return resp.GetReady().GetValue()
+	}
+	if !ready() {
+		t.Fatal("Probe not ready with a writable state dir")
+	}
+
+	// A probe still blocked on a hung state dir fails the next one rather
+	// than piling up another write behind it.
+	d.health.writeProbing.Store(true)
+	if err := d.stateDirWritable(); err == nil || !strings.Contains(err.Error(), "still blocked") {
+		t.Errorf("stateDirWritable during a blocked probe: got %v, want an error", err)
+	}
+	if ready() {
+		t.Error("Probe ready while the previous write probe is blocked")
+	}
+	d.health.writeProbing.Store(false)
+	if !ready() {
+		t.Error("Probe not ready after the blocked write probe finished")
+	}
+
+	if err := os.RemoveAll(d.stateDir); err != nil {
+		t.Fatal(err)
+	}
+	if ready() {
+		t.Error("Probe ready with the state dir gone")
+	}
+}
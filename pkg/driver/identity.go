@@ -4,25 +4,36 @@ import (
 	"context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/example/demo-csi-plugin/pkg/version"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
-const driverVersion = "v0.1.0"
-
 type identityServer struct {
 	d *Driver
 }
 
-// GetPluginInfo returns the driver name and version.
+// GetPluginInfo returns the driver name and version. The manifest carries
+// the commit and build date when the binary was built with them.
 func (s *identityServer) GetPluginInfo(_ context.Context, _ *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	manifest := map[string]string{}
+	if c := version.GitCommit(); c != "" {
+		manifest["gitCommit"] = c
+	}
+	if d := version.BuildDate(); d != "" {
+		manifest["buildDate"] = d
+	}
 	return &csi.GetPluginInfoResponse{
 		Name:          driverName,
-		VendorVersion: driverVersion,
+		VendorVersion: version.Version(),
+		Manifest:      manifest,
 	}, nil
 }
 
-// GetPluginCapabilities advertises that this driver implements the Controller service.
+// GetPluginCapabilities advertises that this driver implements the Controller
+// service, can expand volumes while they are in use, and pins volumes to the
+// node that created them through topology.
 func (s *identityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
@@ -33,14 +44,30 @@ func (s *identityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPlug
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
-// Probe is a health check. We always return ready.
+// Probe is a health check. We report ready only if every registered health
+// check passes; the failing checks are logged by name.
 func (s *identityServer) Probe(_ context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	if req == nil {
 		return nil, status.Error(codes.InvalidArgument, "nil request")
 	}
-	return &csi.ProbeResponse{}, nil
+	_, ready := s.d.runHealthChecks()
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(ready)}, nil
 }
@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/example/demo-csi-plugin/pkg/version"
+)
+
+func TestGetPluginInfo(t *testing.T) {
+	tests := []struct {
+		name              string
+		ver, commit, date string
+		wantVersion       string
+		wantManifest      map[string]string
+	}{
+		{
+			name:         "linked in",
+			ver:          "v1.2.3",
+			commit:       "0123abc",
+			date:         "2024-01-02T03:04:05Z",
+			wantVersion:  "v1.2.3",
+			wantManifest: map[string]string{"gitCommit": "0123abc", "buildDate": "2024-01-02T03:04:05Z"},
+		},
+		{
+			name:         "unset",
+			wantVersion:  "v0.0.0-dev",
+			wantManifest: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer version.SetForTesting(tt.ver, tt.commit, tt.date)()
+			resp, err := (&identityServer{}).GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+			if err != nil {
+				t.Fatalf("GetPluginInfo: %v", err)
+			}
+			if resp.GetName() != driverName {
+				t.Errorf("Name = %q, want %q", resp.GetName(), driverName)
+			}
+			if resp.GetVendorVersion() != tt.wantVersion {
+				t.Errorf("VendorVersion = %q, want %q", resp.GetVendorVersion(), tt.wantVersion)
+			}
+			if !maps.Equal(resp.GetManifest(), tt.wantManifest) {
+				t.Errorf("Manifest = %v, want %v", resp.GetManifest(), tt.wantManifest)
+			}
+		})
+	}
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	resp, err := (&identityServer{}).GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("GetPluginCapabilities: %v", err)
+	}
+	services := map[csi.PluginCapability_Service_Type]bool{}
+	var expansion csi.PluginCapability_VolumeExpansion_Type
+	for _, c := range resp.GetCapabilities() {
+		if s := c.GetService(); s != nil {
+			services[s.GetType()] = true
+		}
+		if e := c.GetVolumeExpansion(); e != nil {
+			expansion = e.GetType()
+		}
+	}
+	for _, want := range []csi.PluginCapability_Service_Type{
+		csi.PluginCapability_Service_CONTROLLER_SERVICE,
+		csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+	} {
+		if !services[want] {
+			t.Errorf("%s not advertised", want)
+		}
+	}
+	// There are no group snapshot RPCs, so the external-snapshotter must
+	// not be told to call them.
+	if services[csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE] {
+		t.Error("GROUP_CONTROLLER_SERVICE advertised without group snapshot support")
+	}
+	if expansion != csi.PluginCapability_VolumeExpansion_ONLINE {
+		t.Errorf("volume expansion = %s, want ONLINE", expansion)
+	}
+}
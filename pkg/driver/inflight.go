@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"sync"
+	"time"
+)
+
+// inflightTracker counts in-progress operations per volume ID so that another
+// operation on the same volume can wait for them to finish.
+type inflightTracker struct {
+	mu  sync.Mutex
+	ops map[string]*inflightOps
+}
+
+type inflightOps struct {
+	count int
+	// done is closed when count drops back to zero.
+	done chan struct{}
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{ops: make(map[string]*inflightOps)}
+}
+
+// begin records an operation on volumeID and returns the function that ends it.
+func (t *inflightTracker) begin(volumeID string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	op, ok := t.ops[volumeID]
+	if !ok {
+		op = &inflightOps{done: make(chan struct{})}
+		t.ops[volumeID] = op
+	}
+	op.count++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		op.count--
+		if op.count == 0 {
+			close(op.done)
+			delete(t.ops, volumeID)
+		}
+	}
+}
+
+// wait blocks until no operation on volumeID is in flight or timeout elapses,
+// and reports whether the operations drained.
+func (t *inflightTracker) wait(volumeID string, timeout time.Duration) bool {
+	t.mu.Lock()
+	op, ok := t.ops[volumeID]
+	t.mu.Unlock()
+	if !ok {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-op.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// volumeContextForcePublish is the volume context key that lets
+// NodeStageVolume take over a volume whose lease is held by another node.
+const volumeContextForcePublish = "force-publish"
+
+// publishLease records which node has a single-node volume staged. It lives
+// in the volume metadata, so it is only seen by other nodes when stateDir is
+// shared storage. The holder renews it while the volume stays staged;
+// anything not renewed within PublishLeaseTTL is considered stale.
+type publishLease struct {
+	NodeID    string    `json:"nodeId"`
+	RenewTime time.Time `json:"renewTime"`
+}
+
+// singleNodeMode reports whether mode allows the volume on one node only.
+func singleNodeMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// acquireLease takes the publish lease of volumeID for this node and reports
+// whether this node held it already. It fails with FailedPrecondition while
+// another node holds a fresh lease, unless force is set. The metadata update
+// is a plain read-modify-write, so two nodes racing for a free lease are not
+// excluded; the lease catches the common case of a volume left staged on
+// another node.
+func (d *Driver) acquireLease(volumeID string, force bool) (bool, error) {
+	meta, err := d.loadMeta(volumeID)
+	if os.IsNotExist(err) {
+		meta = &volumeMeta{CreationTime: time.Now().UTC()}
+	} else if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", volumeID, err)
+	}
+	held := meta.Lease != nil && meta.Lease.NodeID == d.nodeID
+
+	if l := meta.Lease; l != nil && l.NodeID != d.nodeID {
+		age := time.Since(l.RenewTime)
+		switch {
+		case age > d.opts.PublishLeaseTTL:
+			klog.Warningf("Lease: id=%s taking over stale lease of node %s (renewed %v ago)", volumeID, l.NodeID, age.Round(time.Second))
+		case force:
+			klog.Warningf("Lease: id=%s forcibly taking over lease of node %s", volumeID, l.NodeID)
+		default:
+			return false, status.Errorf(codes.FailedPrecondition, "volume %s is in use on node %s (lease renewed %v ago)",
+				volumeID, l.NodeID, age.Round(time.Second))
+		}
+	}
+
+	meta.Lease = &publishLease{NodeID: d.nodeID, RenewTime: time.Now().UTC()}
+	if err := d.saveMeta(volumeID, meta); err != nil {
+		return false, fsError(err, "failed to write metadata for volume %s", volumeID)
+	}
+	return held, nil
+}
+
+// releaseLease drops the publish lease of volumeID if this node holds it.
+func (d *Driver) releaseLease(volumeID string) error {
+	meta, err := d.loadMeta(volumeID)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", volumeID, err)
+	}
+	if meta.Lease == nil || meta.Lease.NodeID != d.nodeID {
+		return nil
+	}
+	meta.Lease = nil
+	if err := d.saveMeta(volumeID, meta); err != nil {
+		return fsError(err, "failed to write metadata for volume %s", volumeID)
+	}
+	return nil
+}
+
+// renewLeases renews the leases held by this node three times per TTL, for
+// as long as the driver runs.
+func (d *Driver) renewLeases() {
+	ticker := time.NewTicker(d.opts.PublishLeaseTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(d.stateDir)
+		if err != nil {
+			klog.Errorf("Lease renewal: failed to list %s: %v", d.stateDir, err)
+			continue
+		}
+		mounts, err := readMountInfo(d.opts.MountInfoPath)
+		if err != nil {
+			klog.Errorf("Lease renewal: failed to read mount table: %v", err)
+			continue
+		}
+		bound := make(map[string]bool)
+		for _, id := range volumeMounts(mounts, d.stateDir) {
+			bound[id] = true
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				d.renewLease(e.Name(), bound[e.Name()])
+			}
+		}
+	}
+}
+
+// renewLease renews the lease of volumeID if this node holds it and still
+// has the volume staged: bound says whether a bind mount of its directory
+// exists, loop-backed volumes count as staged while their image is
+// attached. A lease left behind by a volume that is no longer staged is
+// left to expire. The metadata is updated under the volume lock so that it
+// cannot undo a concurrent release or overwrite another update; a volume
+// that is busy is renewed on the next tick.
+func (d *Driver) renewLease(volumeID string, bound bool) {
+	meta, err := d.loadMeta(volumeID)
+	if err != nil || meta.Lease == nil || meta.Lease.NodeID != d.nodeID {
+		return
+	}
+	unlock, ok := d.volumeLocks.tryLock(volumeID)
+	if !ok {
+		klog.V(4).Infof("Lease renewal: id=%s is busy, retrying next time", volumeID)
+		return
+	}
+	defer unlock()
+
+	// Reload: the lease may have changed before we got the lock.
+	meta, err = d.loadMeta(volumeID)
+	if err != nil || meta.Lease == nil || meta.Lease.NodeID != d.nodeID {
+		return
+	}
+	staged := bound
+	if meta.Backing == backingLoop {
+		devs, err := loopDevices(context.Background(), d.imagePath(volumeID))
+		staged = err == nil && len(devs) > 0
+	}
+	if !staged {
+		klog.V(2).Infof("Lease renewal: id=%s is not staged, letting its lease expire", volumeID)
+		return
+	}
+	meta.Lease.RenewTime = time.Now().UTC()
+	if err := d.saveMeta(volumeID, meta); err != nil {
+		klog.Errorf("Lease renewal: id=%s: %v", volumeID, err)
+	}
+}
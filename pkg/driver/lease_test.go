@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublishLeaseContention(t *testing.T) {
+	opts := Options{PublishLeaseTTL: time.Minute}
+	a := newTestDriver(t, opts)
+	// Node b shares node a's state dir, as replicas on shared storage do.
+	b, err := New("other-node", a.stateDir, opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	createTestVolume(t, a, "vol-1")
+
+	if held, err := a.acquireLease("vol-1", false); err != nil || held {
+		t.Fatalf("first acquire on a: held=%t err=%v, want a new lease", held, err)
+	}
+	if held, err := a.acquireLease("vol-1", false); err != nil || !held {
+		t.Fatalf("repeated acquire on a: held=%t err=%v, want the lease held already", held, err)
+	}
+	if _, err := b.acquireLease("vol-1", false); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("acquire on b while a holds the lease: got %v, want FailedPrecondition", err)
+	}
+	// Only the holder's release drops the lease.
+	if err := b.releaseLease("vol-1"); err != nil {
+		t.Fatalf("release on b: %v", err)
+	}
+	if _, err := b.acquireLease("vol-1", false); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("acquire on b after its own release: got %v, want FailedPrecondition", err)
+	}
+	if _, err := b.acquireLease("vol-1", true); err != nil {
+		t.Fatalf("forced acquire on b: %v", err)
+	}
+	if err := b.releaseLease("vol-1"); err != nil {
+		t.Fatalf("release on b: %v", err)
+	}
+	if _, err := a.acquireLease("vol-1", false); err != nil {
+		t.Fatalf("acquire on a after b released: %v", err)
+	}
+}
+
+func TestPublishLeaseStaleTakeover(t *testing.T) {
+	opts := Options{PublishLeaseTTL: time.Minute}
+	a := newTestDriver(t, opts)
+	b, err := New("other-node", a.stateDir, opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	createTestVolume(t, a, "vol-1")
+	if _, err := a.acquireLease("vol-1", false); err != nil {
+		t.Fatalf("acquire on a: %v", err)
+	}
+
+	// Node a goes away and stops renewing.
+	meta, err := a.loadMeta("vol-1")
+	if err != nil {
+		t.Fatalf("loadMeta: %v", err)
+	}
+	meta.Lease.RenewTime = time.Now().Add(-2 * opts.PublishLeaseTTL)
+	if err := a.saveMeta("vol-1", meta); err != nil {
+		t.Fatalf("saveMeta: %v", err)
+	}
+
+	if _, err := b.acquireLease("vol-1", false); err != nil {
+		t.Fatalf("acquire of a stale lease on b: %v", err)
+	}
+	meta, err = b.loadMeta("vol-1")
+	if err != nil {
+		t.Fatalf("loadMeta: %v", err)
+	}
+	if meta.Lease.NodeID != "other-node" || time.Since(meta.Lease.RenewTime) > time.Minute {
+		t.Errorf("lease after takeover = %+v, want a fresh lease of other-node", meta.Lease)
+	}
+	if _, err := a.acquireLease("vol-1", false); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("acquire on a after the takeover: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestRenewLeaseOnlyWhileStaged(t *testing.T) {
+	d := newTestDriver(t, Options{PublishLeaseTTL: time.Minute})
+	createTestVolume(t, d, "vol-1")
+	if _, err := d.acquireLease("vol-1", false); err != nil {
+		t.Fatalf("acquireLease: %v", err)
+	}
+	old := time.Now().Add(-time.Hour).UTC()
+	setRenewTime := func() {
+		meta, err := d.loadMeta("vol-1")
+		if err != nil {
+			t.Fatalf("loadMeta: %v", err)
+		}
+		meta.Lease.RenewTime = old
+		if err := d.saveMeta("vol-1", meta); err != nil {
+			t.Fatalf("saveMeta: %v", err)
+		}
+	}
+	renewed := func() bool {
+		meta, err := d.loadMeta("vol-1")
+		if err != nil {
+			t.Fatalf("loadMeta: %v", err)
+		}
+		return meta.Lease.RenewTime.After(old)
+	}
+
+	setRenewTime()
+	d.renewLease("vol-1", false)
+	if renewed() {
+		t.Error("lease of an unstaged volume was renewed")
+	}
+	d.renewLease("vol-1", true)
+	if !renewed() {
+		t.Error("lease of a staged volume was not renewed")
+	}
+}
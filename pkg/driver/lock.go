@@ -0,0 +1,120 @@
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks serializes operations on the same volume ID while letting
+// operations on different volumes run in parallel. The same type keys the
+// snapshot locks by snapshot ID.
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	sync.RWMutex
+	// refs counts holders and waiters; the entry is dropped at zero.
+	refs int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[string]*volumeLock)}
+}
+
+// lock waits until volumeID is free, takes it and returns the function that
+// releases it. If ctx is done first it gives up and returns the matching
+// gRPC status (DeadlineExceeded or Canceled).
+func (v *volumeLocks) lock(ctx context.Context, volumeID string) (func(), error) {
+	l := v.ref(volumeID)
+	return v.acquire(ctx, volumeID, l, l.TryLock, l.Lock, l.Unlock)
+}
+
+// rlock is lock shared with other rlock holders: it waits only while
+// volumeID is held by lock.
+func (v *volumeLocks) rlock(ctx context.Context, volumeID string) (func(), error) {
+	l := v.ref(volumeID)
+	return v.acquire(ctx, volumeID, l, l.TryRLock, l.RLock, l.RUnlock)
+}
+
+// acquire takes l with take, bounded by ctx. A sync.RWMutex cannot stop
+// waiting, so the wait happens in a goroutine that hands the lock back if
+// the caller has given up by the time it gets it.
+func (v *volumeLocks) acquire(ctx context.Context, volumeID string, l *volumeLock, try func() bool, take, release func()) (func(), error) {
+	unlock := func() {
+		release()
+		v.unref(volumeID, l)
+	}
+	if try() {
+		return unlock, nil
+	}
+	taken := make(chan struct{})
+	go func() {
+		take()
+		close(taken)
+	}()
+	select {
+	case <-taken:
+		return unlock, nil
+	case <-ctx.Done():
+		go func() {
+			<-taken
+			unlock()
+		}()
+		return nil, status.Errorf(status.FromContextError(ctx.Err()).Code(), "gave up waiting for %s: %v", volumeID, ctx.Err())
+	}
+}
+
+// tryRLock is rlock without waiting: it returns nil and false if volumeID is
+// held by lock.
+func (v *volumeLocks) tryRLock(volumeID string) (func(), bool) {
+	l := v.ref(volumeID)
+	if !l.TryRLock() {
+		v.unref(volumeID, l)
+		return nil, false
+	}
+	return func() {
+		l.RUnlock()
+		v.unref(volumeID, l)
+	}, true
+}
+
+// tryLock takes volumeID if nobody holds it. It returns the release function
+// and true, or nil and false without waiting.
+func (v *volumeLocks) tryLock(volumeID string) (func(), bool) {
+	l := v.ref(volumeID)
+	if !l.TryLock() {
+		v.unref(volumeID, l)
+		return nil, false
+	}
+	return func() {
+		l.Unlock()
+		v.unref(volumeID, l)
+	}, true
+}
+
+// ref returns the lock of volumeID, creating it if needed, and counts the
+// caller as a holder.
+func (v *volumeLocks) ref(volumeID string) *volumeLock {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	l, ok := v.locks[volumeID]
+	if !ok {
+		l = &volumeLock{}
+		v.locks[volumeID] = l
+	}
+	l.refs++
+	return l
+}
+
+func (v *volumeLocks) unref(volumeID string, l *volumeLock) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(v.locks, volumeID)
+	}
+}
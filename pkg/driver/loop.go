@@ -0,0 +1,261 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// paramBacking selects how a volume is stored. The default is a directory
+// on the shared state filesystem; backingLoop gives the volume its own
+// filesystem in an image file that the node attaches to a loop device.
+const (
+	paramBacking = "backing"
+	backingLoop  = "loop"
+)
+
+// defaultLoopFSType is used when the volume capability names no fsType.
+const defaultLoopFSType = "ext4"
+
+// mkfsArgs holds the mkfs invocation for each supported filesystem, minus
+// the image path.
+var mkfsArgs = map[string][]string{
+	"ext4": {"mkfs.ext4", "-q", "-F"},
+	"xfs":  {"mkfs.xfs", "-q", "-f"},
+}
+
+// imagePath is the image file of a loop-backed volume: stateDir/<id>.img.
+func (d *Driver) imagePath(volumeID string) string {
+	return filepath.Join(d.stateDir, volumeID+".img")
+}
+
+// loopFSType returns the filesystem to format a loop-backed volume with: the
+// fsType of the mount capabilities, which must agree, or defaultLoopFSType.
+// Block capabilities ask for a raw image, for which it returns "".
+func loopFSType(caps []*csi.VolumeCapability) (string, error) {
+	fsType := ""
+	block, mount := false, false
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			block = true
+			continue
+		}
+		mount = true
+		t := c.GetMount().GetFsType()
+		if t == "" {
+			continue
+		}
+		if fsType != "" && t != fsType {
+			return "", status.Errorf(codes.InvalidArgument, "conflicting fsTypes %q and %q", fsType, t)
+		}
+		fsType = t
+	}
+	if block && mount {
+		return "", status.Error(codes.InvalidArgument, "a volume cannot have both block and mount access")
+	}
+	if block {
+		return "", nil
+	}
+	if fsType == "" {
+		fsType = defaultLoopFSType
+	}
+	if _, ok := mkfsArgs[fsType]; !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unsupported fsType %q for a loop-backed volume (use ext4 or xfs)", fsType)
+	}
+	return fsType, nil
+}
+
+// createImage allocates a sparse image of sizeBytes for volumeID and, if
+// fsType is set, formats it. The image is built under a temporary name and
+// renamed into place, so a half-formatted image is never mistaken for a
+// finished one.
+func (d *Driver) createImage(ctx context.Context, volumeID string, sizeBytes int64, fsType string) error {
+	img := d.imagePath(volumeID)
+	tmp := filepath.Join(d.stateDir, ".tmp-"+volumeID+".img")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fsError(err, "failed to clean up %q", tmp)
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return fsError(err, "failed to create image %q", tmp)
+	}
+	err = f.Truncate(sizeBytes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fsError(err, "failed to size image %q", tmp)
+	}
+
+	if fsType != "" {
+		args := append(append([]string(nil), mkfsArgs[fsType]...), tmp)
+		if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+			os.Remove(tmp)
+			return status.Errorf(codes.Internal, "%s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.Rename(tmp, img); err != nil {
+		os.Remove(tmp)
+		return fsError(err, "failed to move image %q into place", img)
+	}
+	klog.Infof("CreateVolume: id=%s image=%s size=%d fsType=%s", volumeID, img, sizeBytes, fsType)
+	return nil
+}
+
+// growArgs holds the command that grows a mounted filesystem of each
+// supported type, minus its target: the device for resize2fs, the mount
+// point for xfs_growfs.
+var growArgs = map[string][]string{
+	"ext4": {"resize2fs"},
+	"xfs":  {"xfs_growfs"},
+}
+
+// growImage extends the image of volumeID to sizeBytes. Attached loop
+// devices keep their old size until growLoop refreshes them on the node.
+func (d *Driver) growImage(volumeID string, sizeBytes int64) error {
+	img := d.imagePath(volumeID)
+	if err := os.Truncate(img, sizeBytes); err != nil {
+		return fsError(err, "failed to grow image %q", img)
+	}
+	return nil
+}
+
+// growLoop makes the loop device of img pick up the image's new size and,
+// for formatted images, grows the filesystem mounted at mountPath to fill
+// it.
+func growLoop(ctx context.Context, img, fsType, mountPath string) error {
+	devs, err := loopDevices(ctx, img)
+	if err != nil {
+		return err
+	}
+	if len(devs) == 0 {
+		return fmt.Errorf("%s is not attached to a loop device", img)
+	}
+	dev := devs[0]
+	if out, err := exec.CommandContext(ctx, "losetup", "-c", dev).CombinedOutput(); err != nil {
+		return fmt.Errorf("losetup -c %s: %w: %s", dev, err, strings.TrimSpace(string(out)))
+	}
+	if fsType == "" {
+		return nil
+	}
+	target := dev
+	if fsType == "xfs" {
+		target = mountPath
+	}
+	args := append(append([]string(nil), growArgs[fsType]...), target)
+	if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// loopDevices returns the loop devices img is attached to.
+func loopDevices(ctx context.Context, img string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "losetup", "-j", img).Output()
+	if err != nil {
+		return nil, fmt.Errorf("losetup -j %s: %w", img, err)
+	}
+	var devs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if dev, _, ok := strings.Cut(line, ":"); ok {
+			devs = append(devs, dev)
+		}
+	}
+	return devs, nil
+}
+
+// attachLoop returns a loop device backed by img, reusing one that is
+// already attached (e.g. by a stage attempt that failed later).
+func attachLoop(ctx context.Context, img string) (string, error) {
+	devs, err := loopDevices(ctx, img)
+	if err != nil {
+		return "", err
+	}
+	if len(devs) > 0 {
+		return devs[0], nil
+	}
+	out, err := exec.CommandContext(ctx, "losetup", "--find", "--show", img).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("losetup --find --show %s: %w: %s", img, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// detachLoop detaches the loop device dev.
+func detachLoop(ctx context.Context, dev string) error {
+	if out, err := exec.CommandContext(ctx, "losetup", "-d", dev).CombinedOutput(); err != nil {
+		return fmt.Errorf("losetup -d %s: %w: %s", dev, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// detachImage detaches every loop device img is attached to.
+func detachImage(ctx context.Context, img string) error {
+	devs, err := loopDevices(ctx, img)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		if err := detachLoop(ctx, dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sysBlockDir is where sysfs lists block devices; tests point it elsewhere.
+var sysBlockDir = "/sys/block"
+
+// loopBackingFile returns the file loop device dev (a path or a name such as
+// "loop3") is attached to, or "" if it is not attached.
+func loopBackingFile(dev string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysBlockDir, filepath.Base(dev), "loop", "backing_file"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// loopVolumeMounts is volumeMounts for loop-backed volumes: it returns
+// target → volume ID for every mount of a loop device attached to an image
+// in stateDir. That covers the staging mount of a formatted image, the bind
+// mounts published from it (they keep the loop device as their source) and
+// the bind mounts of the device node itself that publish raw block volumes.
+func loopVolumeMounts(mounts []mountInfo, stateDir string) map[string]string {
+	targets := make(map[string]string)
+	for _, m := range mounts {
+		dev := m.Source
+		if !isLoopDevice(dev) {
+			// A bind of a device node has the node as its root.
+			if m.FSType != "devtmpfs" || !strings.HasPrefix(filepath.Base(m.Root), "loop") {
+				continue
+			}
+			dev = "/dev/" + filepath.Base(m.Root)
+		}
+		backing, err := loopBackingFile(dev)
+		if err != nil || backing == "" || !sameFile(filepath.Dir(backing), stateDir) {
+			continue
+		}
+		if id, ok := strings.CutSuffix(filepath.Base(backing), ".img"); ok {
+			targets[m.MountPoint] = id
+		}
+	}
+	return targets
+}
+
+// isLoopDevice reports whether a mount source is a loop device.
+func isLoopDevice(source string) bool {
+	return strings.HasPrefix(source, "/dev/loop")
+}
@@ -0,0 +1,314 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// blockCapability is a single-node-writer raw block volume capability.
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+// fsCapability is mountCapability formatted as fsType.
+func fsCapability(fsType string) *csi.VolumeCapability {
+	c := mountCapability()
+	c.GetMount().FsType = fsType
+	return c
+}
+
+func TestLoopFSType(t *testing.T) {
+	tests := []struct {
+		name     string
+		caps     []*csi.VolumeCapability
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "default", caps: []*csi.VolumeCapability{mountCapability()}, want: defaultLoopFSType},
+		{name: "xfs", caps: []*csi.VolumeCapability{fsCapability("xfs")}, want: "xfs"},
+		{name: "agreeing", caps: []*csi.VolumeCapability{mountCapability(), fsCapability("xfs"), fsCapability("xfs")}, want: "xfs"},
+		{name: "block", caps: []*csi.VolumeCapability{blockCapability()}, want: ""},
+		{name: "conflicting fsTypes", caps: []*csi.VolumeCapability{fsCapability("ext4"), fsCapability("xfs")}, wantCode: codes.InvalidArgument},
+		{name: "block and mount", caps: []*csi.VolumeCapability{blockCapability(), mountCapability()}, wantCode: codes.InvalidArgument},
+		{name: "unsupported fsType", caps: []*csi.VolumeCapability{fsCapability("btrfs")}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loopFSType(tt.caps)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("loopFSType: got %v, want %v", err, tt.wantCode)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("loopFSType = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopVolumeMounts(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	fakeLoopDevice(t, "loop1", d.imagePath("vol-1"))
+	fakeLoopDevice(t, "loop2", d.imagePath("vol-2"))
+	fakeLoopDevice(t, "loop3", filepath.Join(t.TempDir(), "vol-3.img"))
+	fakeLoopDevice(t, "loop4", filepath.Join(d.stateDir, "notes.txt"))
+	mounts, err := readMountInfo(writeMountInfo(t,
+		"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+		"2 1 7:1 / /staging/vol-1 rw - ext4 /dev/loop1 rw",
+		"3 1 7:1 / /pods/a/vol rw - ext4 /dev/loop1 rw",
+		"4 1 0:5 /loop2 /pods/b/dev rw - devtmpfs devtmpfs rw",
+		// Images outside the state dir, files that are not images, loop
+		// devices that are not attached and other device nodes are ignored.
+		"5 1 7:3 / /pods/c/vol rw - ext4 /dev/loop3 rw",
+		"6 1 7:4 / /pods/d/vol rw - ext4 /dev/loop4 rw",
+		"7 1 7:9 / /pods/e/vol rw - ext4 /dev/loop9 rw",
+		"8 1 0:5 /sda1 /pods/f/dev rw - devtmpfs devtmpfs rw",
+	))
+	if err != nil {
+		t.Fatalf("readMountInfo: %v", err)
+	}
+	want := map[string]string{
+		"/staging/vol-1": "vol-1",
+		"/pods/a/vol":    "vol-1",
+		"/pods/b/dev":    "vol-2",
+	}
+	got := loopVolumeMounts(mounts, d.stateDir)
+	if len(got) != len(want) {
+		t.Errorf("loopVolumeMounts = %v, want %v", got, want)
+	}
+	for target, id := range want {
+		if got[target] != id {
+			t.Errorf("loopVolumeMounts[%s] = %q, want %q", target, got[target], id)
+		}
+	}
+}
+
+func TestCreateLoopVolume(t *testing.T) {
+	tests := []struct {
+		name   string
+		cap    *csi.VolumeCapability
+		fsType string
+	}{
+		{name: "raw", cap: blockCapability()},
+		{name: "ext4", cap: mountCapability(), fsType: "ext4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fsType != "" {
+				if _, err := exec.LookPath(mkfsArgs[tt.fsType][0]); err != nil {
+					t.Skipf("%s not available: %v", mkfsArgs[tt.fsType][0], err)
+				}
+			}
+			d := newTestDriver(t, Options{})
+			const size = 16 << 20
+			_, err := (&controllerServer{d: d}).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "vol-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+				VolumeCapabilities: []*csi.VolumeCapability{tt.cap},
+				Parameters:         map[string]string{paramBacking: backingLoop},
+			})
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			fi, err := os.Stat(d.imagePath("vol-1"))
+			if err != nil {
+				t.Fatalf("image: %v", err)
+			}
+			if fi.Size() != size {
+				t.Errorf("image size = %d, want %d", fi.Size(), size)
+			}
+			meta, err := d.loadMeta("vol-1")
+			if err != nil {
+				t.Fatalf("loadMeta: %v", err)
+			}
+			if meta.Backing != backingLoop || meta.FSType != tt.fsType {
+				t.Errorf("meta backing=%q fsType=%q, want %q and %q", meta.Backing, meta.FSType, backingLoop, tt.fsType)
+			}
+		})
+	}
+}
+
+func TestControllerExpandLoopVolume(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	ctx := context.Background()
+	_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 16 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability()},
+		Parameters:         map[string]string{paramBacking: backingLoop},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	createTestVolume(t, d, "vol-2")
+
+	resp, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "vol-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 32 << 20},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume: %v", err)
+	}
+	if !resp.GetNodeExpansionRequired() || resp.GetCapacityBytes() != 32<<20 {
+		t.Errorf("loop volume: got capacity %d nodeExpansionRequired=%t, want %d and true", resp.GetCapacityBytes(), resp.GetNodeExpansionRequired(), 32<<20)
+	}
+	if fi, err := os.Stat(d.imagePath("vol-1")); err != nil || fi.Size() != 32<<20 {
+		t.Errorf("image after expansion: %v, %v, want %d bytes", fi, err, 32<<20)
+	}
+
+	resp, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "vol-2",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 20},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume: %v", err)
+	}
+	if resp.GetNodeExpansionRequired() {
+		t.Error("directory volume: NodeExpansionRequired = true, want false")
+	}
+}
+
+func TestLoopVolumeCannotBeCopied(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	ctx := context.Background()
+	_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 16 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability()},
+		Parameters:         map[string]string{paramBacking: backingLoop},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	if _, err := cs.CreateVolume(ctx, cloneRequest("vol-2", "vol-1")); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("clone of a loop volume: got %v, want InvalidArgument", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-2")); !os.IsNotExist(err) {
+		t.Errorf("rejected clone left a volume dir: %v", err)
+	}
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: "vol-1"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("snapshot of a loop volume: got %v, want InvalidArgument", err)
+	}
+}
+
+// TestPublishBlockPartialState runs a raw block publish against each state a
+// crash can leave the target in.
+func TestPublishBlockPartialState(t *testing.T) {
+	requireMounts(t)
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skipf("losetup not available: %v", err)
+	}
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	ns := &nodeServer{d: d}
+	ctx := context.Background()
+	for _, id := range []string{"vol-1", "vol-2"} {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               id,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+			VolumeCapabilities: []*csi.VolumeCapability{blockCapability()},
+			Parameters:         map[string]string{paramBacking: backingLoop},
+		})
+		if err != nil {
+			t.Fatalf("CreateVolume %s: %v", id, err)
+		}
+		img := d.imagePath(id)
+		t.Cleanup(func() { detachImage(context.Background(), img) })
+	}
+	target := filepath.Join(t.TempDir(), "dev")
+	t.Cleanup(func() {
+		// Binds may be stacked if a step failed; remove them all.
+		for syscall.Unmount(target, syscall.MNT_DETACH) == nil {
+		}
+	})
+	publish := func() error {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-1",
+			StagingTargetPath: filepath.Join(filepath.Dir(target), "staging"),
+			TargetPath:        target,
+			VolumeCapability:  blockCapability(),
+		})
+		return err
+	}
+	// mountedAt returns the mounts stacked at target.
+	mountedAt := func() []mountInfo {
+		t.Helper()
+		mounts, err := readMountInfo(d.opts.MountInfoPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var at []mountInfo
+		for _, m := range mounts {
+			if m.MountPoint == target {
+				at = append(at, m)
+			}
+		}
+		return at
+	}
+
+	// Not attached: the volume was never staged.
+	if err := publish(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("publish without a loop device: got %v, want FailedPrecondition", err)
+	}
+
+	// Attached but not bound: only the bind is left to do.
+	dev, err := attachLoop(ctx, d.imagePath("vol-1"))
+	if err != nil {
+		t.Fatalf("attachLoop: %v", err)
+	}
+	if err := publish(); err != nil {
+		t.Fatalf("publish of an attached device: %v", err)
+	}
+	if at := mountedAt(); len(at) != 1 || filepath.Base(at[0].Root) != filepath.Base(dev) {
+		t.Fatalf("mounts at target after publish = %v, want one bind of %s", at, dev)
+	}
+
+	// Attached and bound: nothing to do.
+	if err := publish(); err != nil {
+		t.Fatalf("repeated publish: %v", err)
+	}
+	if at := mountedAt(); len(at) != 1 {
+		t.Errorf("mounts at target after a repeated publish = %v, want one", at)
+	}
+
+	// Bound to the device of another image: not ours to replace.
+	if err := syscall.Unmount(target, 0); err != nil {
+		t.Fatal(err)
+	}
+	other, err := attachLoop(ctx, d.imagePath("vol-2"))
+	if err != nil {
+		t.Fatalf("attachLoop: %v", err)
+	}
+	if err := bindMount(other, target, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("publish over another image's device: got %v, want AlreadyExists", err)
+	}
+
+	// Bound to a device that has since been detached, as after a crash
+	// between unstage and unpublish: the stale bind is replaced.
+	if err := detachImage(ctx, d.imagePath("vol-2")); err != nil {
+		t.Fatalf("detachImage: %v", err)
+	}
+	if err := publish(); err != nil {
+		t.Fatalf("publish over a stale device: %v", err)
+	}
+	if at := mountedAt(); len(at) != 1 || filepath.Base(at[0].Root) != filepath.Base(dev) {
+		t.Errorf("mounts at target after replacing the stale bind = %v, want one bind of %s", at, dev)
+	}
+}
@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metaFileName is the metadata file kept inside each volume directory.
+const metaFileName = ".meta.json"
+
+// volumeMeta is what we remember about a volume across driver restarts.
+type volumeMeta struct {
+	CapacityBytes int64             `json:"capacityBytes"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+	CreationTime  time.Time         `json:"creationTime"`
+	// ProjectID is the XFS project enforcing the capacity, or 0 if none.
+	ProjectID uint32 `json:"projectId,omitempty"`
+	// Lease is the node that has the volume staged, when publish leases
+	// are enabled.
+	Lease *publishLease `json:"lease,omitempty"`
+	// Backing is backingLoop for volumes stored in an image file, formatted
+	// with FSType; empty for plain directories.
+	Backing string `json:"backing,omitempty"`
+	FSType  string `json:"fsType,omitempty"`
+	// Ephemeral marks an inline volume created by NodePublishVolume; it is
+	// deleted when unpublished.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
+
+func (d *Driver) metaPath(volumeID string) string {
+	return filepath.Join(d.stateDir, volumeID, metaFileName)
+}
+
+// loadMeta reads the metadata of volumeID. It returns an error satisfying
+// os.IsNotExist when the volume has none.
+func (d *Driver) loadMeta(volumeID string) (*volumeMeta, error) {
+	data, err := os.ReadFile(d.metaPath(volumeID))
+	if err != nil {
+		return nil, err
+	}
+	var m volumeMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("corrupt metadata for volume %s: %w", volumeID, err)
+	}
+	return &m, nil
+}
+
+// saveMeta atomically replaces the metadata of volumeID. The volume
+// directory must already exist.
+func (d *Driver) saveMeta(volumeID string, m *volumeMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata for volume %s: %w", volumeID, err)
+	}
+	return writeFileAtomic(d.metaPath(volumeID), data, 0640)
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"context"
+	"maps"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestMetaSurvivesRestart(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	params := map[string]string{"tier": "gold"}
+	before := time.Now().UTC()
+	_, err := (&controllerServer{d: d}).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         params,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	after := time.Now().UTC()
+
+	// A fresh Driver on the same state dir knows nothing but what is on disk.
+	restarted, err := New("test-node", d.stateDir, Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	meta, err := restarted.loadMeta("vol-1")
+	if err != nil {
+		t.Fatalf("loadMeta: %v", err)
+	}
+	if meta.CapacityBytes != 1<<20 {
+		t.Errorf("CapacityBytes = %d, want %d", meta.CapacityBytes, 1<<20)
+	}
+	if !maps.Equal(meta.Parameters, params) {
+		t.Errorf("Parameters = %v, want %v", meta.Parameters, params)
+	}
+	if meta.CreationTime.Before(before) || meta.CreationTime.After(after) {
+		t.Errorf("CreationTime = %v, want between %v and %v", meta.CreationTime, before, after)
+	}
+
+	resp, err := (&controllerServer{d: restarted}).ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"})
+	if err != nil {
+		t.Fatalf("ControllerGetVolume: %v", err)
+	}
+	if got := resp.GetVolume().GetCapacityBytes(); got != 1<<20 {
+		t.Errorf("ControllerGetVolume capacity = %d, want %d", got, 1<<20)
+	}
+}
+
+func TestLoadMetaMissing(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	if _, err := d.loadMeta("no-such-volume"); !os.IsNotExist(err) {
+		t.Fatalf("loadMeta: got %v, want a not-exist error", err)
+	}
+}
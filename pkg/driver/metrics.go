@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// rpcMetrics holds the Prometheus collectors fed by the RPC interceptors.
+// Each driver has its own registry so that creating more than one Driver in
+// a process does not panic on duplicate registration.
+type rpcMetrics struct {
+	registry *prometheus.Registry
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	// staleSockets counts unix socket cleanups at startup by result:
+	// removed, failed, or live (left alone because a process serves it).
+	staleSockets *prometheus.CounterVec
+
+	// inflight counts RPCs being handled and conns open client
+	// connections; both are exported as gauges and logged while the
+	// server drains on shutdown.
+	inflight atomic.Int64
+	conns    atomic.Int64
+}
+
+// metricLabels are the only label names the driver's metrics may use. Each
+// has a small, fixed set of values; per-volume detail (volume IDs, paths)
+// would grow the series count with the cluster and belongs on the debug
+// endpoint (/debug/volumes) instead.
+var metricLabels = map[string]bool{
+	"method": true,
+	"code":   true,
+	"result": true,
+}
+
+// boundedLabels returns names, panicking if any of them is not in
+// metricLabels. Every labelled collector is built with it, so adding a
+// high-cardinality label fails at startup instead of in Prometheus.
+func boundedLabels(names ...string) []string {
+	for _, n := range names {
+		if !metricLabels[n] {
+			panic(fmt.Sprintf("metric label %q is not in the bounded label set", n))
+		}
+	}
+	return names
+}
+
+func newRPCMetrics() *rpcMetrics {
+	m := &rpcMetrics{
+		registry: prometheus.NewRegistry(),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "csi_rpc_duration_seconds",
+			Help:    "Duration of CSI RPCs by gRPC method and status code.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, boundedLabels("method", "code")),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "csi_rpc_errors_total",
+			Help: "CSI RPCs that returned an error, by gRPC method and status code.",
+		}, boundedLabels("method", "code")),
+		staleSockets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "csi_stale_socket_cleanups_total",
+			Help: "Leftover unix sockets found when listening, by result: removed, failed or live.",
+		}, boundedLabels("result")),
+	}
+	m.registry.MustRegister(
+		m.duration,
+		m.errors,
+		m.staleSockets,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "csi_rpc_inflight",
+			Help: "CSI RPCs currently being handled.",
+		}, func() float64 { return float64(m.inflight.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "csi_grpc_connections_active",
+			Help: "Open gRPC client connections.",
+		}, func() float64 { return float64(m.conns.Load()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observe records one finished RPC.
+func (m *rpcMetrics) observe(method string, elapsed time.Duration, err error) {
+	code := status.Code(err).String()
+	m.duration.WithLabelValues(method, code).Observe(elapsed.Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(method, code).Inc()
+	}
+}
+
+// connStats is a gRPC stats handler that keeps rpcMetrics.conns up to date.
+type connStats struct {
+	m *rpcMetrics
+}
+
+func (h connStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context   { return ctx }
+func (h connStats) HandleRPC(context.Context, stats.RPCStats)                         {}
+func (h connStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+func (h connStats) HandleConn(_ context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		h.m.conns.Add(1)
+	case *stats.ConnEnd:
+		h.m.conns.Add(-1)
+	}
+}
+
+// startMetricsServer serves /metrics on MetricsAddr in the background.
+func (d *Driver) startMetricsServer() error {
+	listener, err := d.listen("tcp", d.opts.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metricsHandler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			klog.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+	klog.Infof("Metrics server listening on %s", d.opts.MetricsAddr)
+	return nil
+}
+
+// metricsHandler serves the driver's registry in the Prometheus text format.
+func (d *Driver) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(d.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// scrapeMetrics returns the text exposition of d's metrics.
+func scrapeMetrics(t *testing.T, d *Driver) string {
+	t.Helper()
+	srv := httptest.NewServer(d.metricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetricsAfterRPC(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	createVolume := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return cs.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+	}
+
+	ok := &csi.CreateVolumeRequest{Name: "vol-1", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()}}
+	if _, err := d.logInterceptor(context.Background(), ok, info, createVolume); err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	bad := &csi.CreateVolumeRequest{Name: "vol-2"}
+	if _, err := d.logInterceptor(context.Background(), bad, info, createVolume); err == nil {
+		t.Fatal("CreateVolume without capabilities succeeded")
+	}
+
+	body := scrapeMetrics(t, d)
+	for _, want := range []string{
+		`csi_rpc_duration_seconds_count{code="OK",method="/csi.v1.Controller/CreateVolume"} 1`,
+		`csi_rpc_duration_seconds_count{code="InvalidArgument",method="/csi.v1.Controller/CreateVolume"} 1`,
+		`csi_rpc_errors_total{code="InvalidArgument",method="/csi.v1.Controller/CreateVolume"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+	if strings.Contains(body, `csi_rpc_errors_total{code="OK"`) {
+		t.Error("a successful RPC was counted as an error")
+	}
+}
+
+func TestStreamRPCLoggedAndCounted(t *testing.T) {
+	logs := captureKlog(t)
+	d := newTestDriver(t, Options{})
+	const method = "/demo.v1.Debug/TailLog"
+	info := &grpc.StreamServerInfo{FullMethod: method, IsServerStream: true}
+	stream := func(err error) error {
+		return d.logStreamInterceptor(nil, nil, info, func(interface{}, grpc.ServerStream) error {
+			return err
+		})
+	}
+
+	if err := stream(nil); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if err := stream(status.Error(codes.NotFound, "no such log")); status.Code(err) != codes.NotFound {
+		t.Fatalf("failing stream: got %v, want NotFound", err)
+	}
+	klog.Flush()
+
+	if out := logs.String(); !strings.Contains(out, "RPC failed") || !strings.Contains(out, method) {
+		t.Errorf("failed stream not logged in:\n%s", out)
+	}
+	body := scrapeMetrics(t, d)
+	for _, want := range []string{
+		`csi_rpc_duration_seconds_count{code="OK",method="` + method + `"} 1`,
+		`csi_rpc_errors_total{code="NotFound",method="` + method + `"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+// blockingIdentity is an identity service whose Probe waits for release.
+type blockingIdentity struct {
+	csi.UnimplementedIdentityServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingIdentity) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	close(b.started)
+	<-b.release
+	return &csi.ProbeResponse{}, nil
+}
+
+func TestDrainInflightGauge(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(d.logInterceptor),
+		grpc.StatsHandler(connStats{m: d.metrics}),
+	)
+	identity := &blockingIdentity{started: make(chan struct{}), release: make(chan struct{})}
+	csi.RegisterIdentityServer(server, identity)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	probed := make(chan error, 1)
+	go func() {
+		_, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{})
+		probed <- err
+	}()
+	<-identity.started
+
+	body := scrapeMetrics(t, d)
+	for _, want := range []string{"csi_rpc_inflight 1", "csi_grpc_connections_active 1"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics during the RPC do not contain %s", want)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		d.drain(server)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain returned with an RPC in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(identity.release)
+	if err := <-probed; err != nil {
+		t.Errorf("Probe: %v", err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("drain did not return after the RPC finished")
+	}
+	if !strings.Contains(scrapeMetrics(t, d), "csi_rpc_inflight 0") {
+		t.Error("in-flight gauge did not drop to 0 after draining")
+	}
+}
+
+func TestMetricsLabelsBounded(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeGetVolumeStats"}
+	for _, id := range []string{"vol-1", "vol-2", "vol-3"} {
+		d.logInterceptor(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: id}, info,
+			func(context.Context, interface{}) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "not found")
+			})
+	}
+
+	families, err := d.metrics.registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	labelled := 0
+	for _, f := range families {
+		// The Go and process collectors label only with build constants.
+		if !strings.HasPrefix(f.GetName(), "csi_") {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				labelled++
+				if !metricLabels[l.GetName()] {
+					t.Errorf("%s has label %q outside the bounded set", f.GetName(), l.GetName())
+				}
+				if strings.HasPrefix(l.GetValue(), "vol-") {
+					t.Errorf("%s has a volume ID as the value of label %q", f.GetName(), l.GetName())
+				}
+			}
+		}
+	}
+	if labelled == 0 {
+		t.Fatal("no labelled csi_ series after the RPCs")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("boundedLabels accepted volume_id")
+		}
+	}()
+	boundedLabels("method", "volume_id")
+}
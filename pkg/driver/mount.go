@@ -0,0 +1,212 @@
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// errNoMountPermission is returned when the kernel refuses a bind mount
+// because the process lacks CAP_SYS_ADMIN.
+var errNoMountPermission = errors.New("missing CAP_SYS_ADMIN for bind mounts")
+
+// mountSyscall is mount(2); tests replace it to simulate a kernel that
+// refuses mounts.
+var mountSyscall = syscall.Mount
+
+// defaultMountInfoPath is where the kernel exposes the mount table of our
+// namespace.
+const defaultMountInfoPath = "/proc/self/mountinfo"
+
+// mountInfo is the subset of a /proc/self/mountinfo line the driver uses.
+type mountInfo struct {
+	// Device is the "major:minor" of the filesystem.
+	Device string
+	// Root is the path within the filesystem that forms the root of this
+	// mount; for a bind mount it is the directory that was bound.
+	Root       string
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// readMountInfo parses the mount table at path.
+func readMountInfo(path string) ([]mountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses the mountinfo format described in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// Optional fields end at the "-" separator, which is followed by
+		// fstype and source.
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			return nil, fmt.Errorf("malformed mountinfo line %q", sc.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			Device:     fields[2],
+			Root:       unescapeMountPath(fields[3]),
+			MountPoint: unescapeMountPath(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	return mounts, sc.Err()
+}
+
+// unescapeMountPath undoes the octal escapes (e.g. "\040" for a space) the
+// kernel uses for whitespace and backslashes in mountinfo paths. Anything
+// that is not a valid three-digit escape is kept as is.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// findMount returns the topmost mount at target, if any. Later lines in
+// mountinfo are stacked on top of earlier ones at the same mount point.
+func findMount(mounts []mountInfo, target string) (mountInfo, bool) {
+	target = filepath.Clean(target)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == target {
+			return mounts[i], true
+		}
+	}
+	return mountInfo{}, false
+}
+
+// volumeMounts returns target → volume ID for every mount in mounts that is a
+// bind mount of a volume directory directly under stateDir. Bind mounts keep
+// the device of the underlying filesystem and record the bound directory as
+// their root, so we locate stateDir within its filesystem and match on that.
+func volumeMounts(mounts []mountInfo, stateDir string) map[string]string {
+	stateDir = filepath.Clean(stateDir)
+	base, found := containingMount(mounts, stateDir)
+	if !found {
+		return nil
+	}
+	rel, err := filepath.Rel(base.MountPoint, stateDir)
+	if err != nil {
+		return nil
+	}
+	stateRoot := filepath.Join(base.Root, rel)
+
+	targets := make(map[string]string)
+	for _, m := range mounts {
+		if m.Device != base.Device || m.MountPoint == base.MountPoint {
+			continue
+		}
+		if filepath.Dir(m.Root) == stateRoot && m.Root != stateRoot {
+			targets[m.MountPoint] = filepath.Base(m.Root)
+		}
+	}
+	return targets
+}
+
+// isBindOf reports whether target is a mount point showing the directory src,
+// i.e. a bind mount of src (or of another bind mount of it). src need not be
+// a mount point itself.
+func isBindOf(mounts []mountInfo, target, src string) bool {
+	m, ok := findMount(mounts, target)
+	if !ok {
+		return false
+	}
+	src = filepath.Clean(src)
+	base, ok := containingMount(mounts, src)
+	if !ok {
+		return false
+	}
+	rel, err := filepath.Rel(base.MountPoint, src)
+	if err != nil {
+		return false
+	}
+	return m.Device == base.Device && m.Root == filepath.Join(base.Root, rel)
+}
+
+// containingMount returns the mount that path lives on: the one with the
+// longest mount point that is a prefix of it (the last one wins when mounts
+// are stacked).
+func containingMount(mounts []mountInfo, path string) (mountInfo, bool) {
+	path = filepath.Clean(path)
+	var base mountInfo
+	found := false
+	for _, m := range mounts {
+		if isWithin(path, m.MountPoint) && (!found || len(m.MountPoint) >= len(base.MountPoint)) {
+			base, found = m, true
+		}
+	}
+	return base, found
+}
+
+// isWithin reports whether path is dir or lies beneath it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// probeBindMount checks that we are allowed to create bind mounts by binding
+// a scratch directory under dir onto another and undoing it again.
+func probeBindMount(dir string) error {
+	scratch, err := os.MkdirTemp(dir, ".mount-probe-")
+	if err != nil {
+		return fmt.Errorf("failed to create mount probe dir: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	src := filepath.Join(scratch, "src")
+	dst := filepath.Join(scratch, "dst")
+	for _, p := range []string{src, dst} {
+		if err := os.Mkdir(p, 0750); err != nil {
+			return fmt.Errorf("failed to create mount probe dir: %w", err)
+		}
+	}
+	if err := mountSyscall(src, dst, "", syscall.MS_BIND, ""); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			return errNoMountPermission
+		}
+		return fmt.Errorf("probe bind mount failed: %w", err)
+	}
+	if err := syscall.Unmount(dst, 0); err != nil {
+		return fmt.Errorf("failed to undo probe bind mount %q: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "/var/lib/kubelet/pods/x/volumes", want: "/var/lib/kubelet/pods/x/volumes"},
+		{in: `/mnt/my\040volume`, want: "/mnt/my volume"},
+		{in: `/mnt/tab\011here`, want: "/mnt/tab\there"},
+		{in: `/mnt/new\012line`, want: "/mnt/new\nline"},
+		{in: `/mnt/back\134slash`, want: `/mnt/back\slash`},
+		{in: `/mnt/a\040b\040c`, want: "/mnt/a b c"},
+		// Anything that is not a three-digit octal escape is kept.
+		{in: `/mnt/not\08escape`, want: `/mnt/not\08escape`},
+		{in: `/mnt/short\04`, want: `/mnt/short\04`},
+		{in: `/mnt/trailing\`, want: `/mnt/trailing\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountPath(tt.in); got != tt.want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	// Lines as seen on a containerized kubelet: optional fields, spaces in a
+	// pod's volume path and a bind from a directory with a backslash.
+	input := strings.Join([]string{
+		`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw`,
+		`640 22 8:1 /var/lib/demo-csi/vol-1 /var/lib/kubelet/pods/p1/volumes/kubernetes.io~csi/my\040pv/mount rw,relatime shared:1 master:2 - ext4 /dev/sda1 rw`,
+		`641 22 0:52 / /mnt/tab\011and\012newline rw - tmpfs tmp\134fs rw,size=1024k`,
+		`642 22 7:3 / /var/lib/kubelet/plugins/staging rw,relatime - xfs /dev/loop3 rw`,
+		``,
+	}, "\n")
+	got, err := parseMountInfo(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseMountInfo: %v", err)
+	}
+	want := []mountInfo{
+		{Device: "8:1", Root: "/", MountPoint: "/", FSType: "ext4", Source: "/dev/sda1"},
+		{Device: "8:1", Root: "/var/lib/demo-csi/vol-1", MountPoint: "/var/lib/kubelet/pods/p1/volumes/kubernetes.io~csi/my pv/mount", FSType: "ext4", Source: "/dev/sda1"},
+		{Device: "0:52", Root: "/", MountPoint: "/mnt/tab\tand\nnewline", FSType: "tmpfs", Source: `tmp\fs`},
+		{Device: "7:3", Root: "/", MountPoint: "/var/lib/kubelet/plugins/staging", FSType: "xfs", Source: "/dev/loop3"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseMountInfo returned %d mounts, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("mount %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	for _, line := range []string{
+		"22 1 8:1 / / rw shared:1 ext4 /dev/sda1 rw",
+		"22 1 8:1 / / rw - ext4",
+	} {
+		if _, err := parseMountInfo(strings.NewReader(line)); err == nil {
+			t.Errorf("parseMountInfo accepted malformed line %q", line)
+		}
+	}
+}
+
+// TestMountInfoPath checks that the node plugin reads the mount table it is
+// configured with, such as the host's when it runs in a container.
+func TestMountInfoPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pod dir")
+	staging := filepath.Join(dir, "staging")
+	target := filepath.Join(dir, "mount")
+	escape := func(p string) string { return strings.ReplaceAll(p, " ", `\040`) }
+	d := newTestDriver(t, Options{MountInfoPath: writeMountInfo(t,
+		"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+		"2 1 8:1 /var/lib/demo/vol-1 "+escape(staging)+" rw - ext4 /dev/sda1 rw",
+		"3 1 8:1 /var/lib/demo/vol-1 "+escape(target)+" rw - ext4 /dev/sda1 rw",
+	)})
+
+	// Only the configured table shows the volume staged and published, so
+	// the publish succeeds without mounting anything.
+	_, err := (&nodeServer{d: d}).NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+	})
+	if err != nil {
+		t.Errorf("NodePublishVolume: %v", err)
+	}
+
+	d = newTestDriver(t, Options{MountInfoPath: filepath.Join(t.TempDir(), "missing")})
+	_, err = (&nodeServer{d: d}).NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("NodePublishVolume with an unreadable mount table: got %v, want Internal", err)
+	}
+}
+
+// denyMounts makes every mount fail with EPERM, as it does for a node plugin
+// running without CAP_SYS_ADMIN, until the test ends.
+func denyMounts(t *testing.T) {
+	old := mountSyscall
+	mountSyscall = func(string, string, string, uintptr, string) error { return syscall.EPERM }
+	t.Cleanup(func() { mountSyscall = old })
+}
+
+func TestMountCheckWithoutPermission(t *testing.T) {
+	denyMounts(t)
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{mode: MountCheckOff},
+		{mode: MountCheckWarn},
+		{mode: MountCheckFail, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			_, err := New("test-node", filepath.Join(t.TempDir(), "volumes"), Options{MountCheck: tt.mode})
+			if tt.wantErr {
+				if !errors.Is(err, errNoMountPermission) {
+					t.Errorf("New: got %v, want %v", err, errNoMountPermission)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("New: %v", err)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeWithoutPermission(t *testing.T) {
+	d := newTestDriver(t, Options{MountInfoPath: writeMountInfo(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw")})
+	createTestVolume(t, d, "vol-1")
+	denyMounts(t)
+	_, err := (&nodeServer{d: d}).NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability:  mountCapability(),
+	})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "CAP_SYS_ADMIN") {
+		t.Errorf("NodeStageVolume without mount permission: got %v, want FailedPrecondition naming CAP_SYS_ADMIN", err)
+	}
+}
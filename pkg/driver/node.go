@@ -2,9 +2,15 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -12,92 +18,957 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// publishContextVolumePath is the PublishContext key carrying the resolved
+// backing directory of a volume. A ControllerPublishVolume implementation
+// returns it so that the node side does not have to derive the path itself.
+const publishContextVolumePath = "volumePath"
+
 type nodeServer struct {
 	d *Driver
 	// Embed the unimplemented server to satisfy methods we don't implement.
 	csi.UnimplementedNodeServer
 }
 
-// NodePublishVolume bind-mounts the volume directory into the pod.
+// NodeStageVolume bind-mounts the volume directory at the staging path.
 //
-// Kubernetes calls this after CreateVolume. The volume directory was created by
-// the controller; we just need to make it visible inside the pod's namespace by
-// bind-mounting it at the target path.
-func (s *nodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+// Kubelet stages a volume once per node and then publishes it into each pod
+// that uses it, so the per-volume setup (creating the directory, the symlink
+// scan, applying fsGroup) happens here rather than on every publish.
+func (s *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (_ *csi.NodeStageVolumeResponse, err error) {
+	if !s.d.nodeReady.Load() {
+		return nil, status.Error(codes.Unavailable, "node is still reconciling existing mounts")
+	}
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
-	if req.GetTargetPath() == "" {
-		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
 	}
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
 	}
+	if err := s.d.validateParameters("volume context", req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	volumeDir := filepath.Join(s.d.stateDir, req.GetVolumeId())
-	targetPath := req.GetTargetPath()
+	volumeDir, err := s.volumeSource(req.GetVolumeId(), req.GetPublishContext())
+	if err != nil {
+		return nil, err
+	}
+	stagingPath := req.GetStagingTargetPath()
+
+	if err := s.d.checkStateDir(); err != nil {
+		return nil, err
+	}
 
 	// Ensure the source directory exists (it should have been created by
 	// CreateVolume on the controller, but on single-node clusters that is us).
-	if err := os.MkdirAll(volumeDir, 0750); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create volume dir %q: %v", volumeDir, err)
+	if s.d.opts.AssumeControllerCreated {
+		if err := os.MkdirAll(volumeDir, 0750); err != nil {
+			return nil, fsError(err, "failed to create volume dir %q", volumeDir)
+		}
+	} else if _, err := os.Stat(volumeDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume dir %q does not exist on node %s", volumeDir, s.d.nodeID)
+		}
+		return nil, fsError(err, "failed to stat volume dir %q", volumeDir)
+	}
+
+	// With shared state, another node may already be using a single-node
+	// volume.
+	if s.d.opts.PublishLeaseTTL > 0 && singleNodeMode(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		force := req.GetVolumeContext()[volumeContextForcePublish] == "true"
+		held, lerr := s.d.acquireLease(req.GetVolumeId(), force)
+		if lerr != nil {
+			return nil, lerr
+		}
+		// A lease taken by a stage that then fails would keep every other
+		// node out of the volume. One held before this call stays: the
+		// volume may be staged already.
+		if !held {
+			defer func() {
+				if err == nil {
+					return
+				}
+				if rerr := s.d.releaseLease(req.GetVolumeId()); rerr != nil {
+					klog.Warningf("NodeStageVolume: id=%s: failed to release lease after error: %v", req.GetVolumeId(), rerr)
+				}
+			}()
+		}
+	}
+
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return nil, fsError(err, "failed to create staging dir %q", stagingPath)
+	}
+
+	if meta, err := s.d.loadMeta(req.GetVolumeId()); err == nil && meta.Backing == backingLoop {
+		return s.stageLoop(ctx, req, meta.FSType)
+	}
+
+	if err := s.prepareContent(req, volumeDir); err != nil {
+		return nil, err
+	}
+
+	// A retried stage must not stack a second bind mount on the first.
+	mounts, err := readMountInfo(s.d.opts.MountInfoPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+	}
+	if isBindOf(mounts, stagingPath, volumeDir) {
+		klog.V(4).Infof("NodeStageVolume: %q is already staged at %q", volumeDir, stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	if err := bindMount(volumeDir, stagingPath, 0); err != nil {
+		return nil, err
+	}
+
+	klog.Infof("NodeStageVolume: id=%s src=%s staging=%s", req.GetVolumeId(), volumeDir, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// stageLoop stages a loop-backed volume: it attaches the volume's image to a
+// loop device and mounts that at the staging path. Raw block volumes (no
+// fsType) are only attached; NodePublishVolume binds the device itself.
+func (s *nodeServer) stageLoop(ctx context.Context, req *csi.NodeStageVolumeRequest, fsType string) (*csi.NodeStageVolumeResponse, error) {
+	img := s.d.imagePath(req.GetVolumeId())
+	stagingPath := req.GetStagingTargetPath()
+
+	if fsType == "" {
+		dev, err := attachLoop(ctx, img)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to attach %q: %v", img, err)
+		}
+		klog.Infof("NodeStageVolume: id=%s image=%s device=%s", req.GetVolumeId(), img, dev)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mounts, err := readMountInfo(s.d.opts.MountInfoPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+	}
+	if m, ok := findMount(mounts, stagingPath); ok && isLoopDevice(m.Source) {
+		klog.V(4).Infof("NodeStageVolume: %q is already staged at %q", img, stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	dev, err := attachLoop(ctx, img)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to attach %q: %v", img, err)
+	}
+	if err := mountSyscall(dev, stagingPath, fsType, 0, ""); err != nil {
+		if derr := detachLoop(ctx, dev); derr != nil {
+			klog.Warningf("NodeStageVolume: id=%s: %v", req.GetVolumeId(), derr)
+		}
+		if errors.Is(err, syscall.EPERM) {
+			return nil, status.Errorf(codes.FailedPrecondition, "mount %q → %q failed: %v", dev, stagingPath, errNoMountPermission)
+		}
+		return nil, fsError(err, "mount %q → %q failed", dev, stagingPath)
+	}
+	if err := s.prepareContent(req, stagingPath); err != nil {
+		return nil, err
+	}
+
+	klog.Infof("NodeStageVolume: id=%s image=%s device=%s staging=%s", req.GetVolumeId(), img, dev, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// prepareContent runs the per-volume checks and setup on the volume's files
+// at dir before they are exposed: the symlink scan and the fsGroup.
+func (s *nodeServer) prepareContent(req *csi.NodeStageVolumeRequest, dir string) error {
+	if s.d.opts.RejectEscapingSymlinks {
+		link, err := findEscapingSymlink(dir)
+		if err != nil {
+			return fsError(err, "failed to scan %q for symlinks", dir)
+		}
+		if link != "" {
+			return status.Errorf(codes.FailedPrecondition, "volume %s contains symlink %q pointing outside the volume",
+				req.GetVolumeId(), link)
+		}
+	}
+
+	if gid, ok, err := s.mountGroup(req.GetVolumeCapability()); err != nil {
+		return err
+	} else if ok {
+		if err := applyGroup(dir, gid); err != nil {
+			return fsError(err, "failed to apply fsGroup %d to %q", gid, dir)
+		}
+	}
+	return nil
+}
+
+// NodeUnstageVolume removes the staging bind mount. Like
+// NodeUnpublishVolume it succeeds if the path is not mounted.
+func (s *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if !s.d.nodeReady.Load() {
+		return nil, status.Error(codes.Unavailable, "node is still reconciling existing mounts")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	stagingPath := req.GetStagingTargetPath()
+
+	if err := syscall.Unmount(stagingPath, 0); err != nil {
+		if err != syscall.EINVAL {
+			return nil, fsError(err, "unmount %q failed", stagingPath)
+		}
+		// Already unstaged; a retry may still have to drop the lease.
+		klog.V(4).Infof("NodeUnstageVolume: %q is not mounted, skipping", stagingPath)
+	} else if err := s.d.waitUnmounted(stagingPath, s.d.opts.UnmountVerifyRetries); err != nil {
+		return nil, err
+	}
+	// Detached on every call, so that a retry after a failed detach does
+	// not leak the loop device.
+	if meta, err := s.d.loadMeta(req.GetVolumeId()); err == nil && meta.Backing == backingLoop {
+		if err := detachImage(ctx, s.d.imagePath(req.GetVolumeId())); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to detach loop device: %v", err)
+		}
+	}
+	// Staging mounts are recorded by reconcilePublished like any other
+	// bind mount of a volume.
+	s.d.published.release(stagingPath)
+
+	if s.d.opts.PublishLeaseTTL > 0 {
+		if err := s.d.releaseLease(req.GetVolumeId()); err != nil {
+			return nil, err
+		}
+	}
+
+	klog.Infof("NodeUnstageVolume: id=%s staging=%s", req.GetVolumeId(), stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind-mounts the staged volume into the pod.
+//
+// Kubernetes calls this after NodeStageVolume, once for every pod using the
+// volume on this node. The staging path already shows the volume directory;
+// we just need to make it visible inside the pod's namespace by bind-mounting
+// it at the target path.
+func (s *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if !s.d.nodeReady.Load() {
+		return nil, status.Error(codes.Unavailable, "node is still reconciling existing mounts")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	ephemeral := isEphemeral(req.GetVolumeContext())
+	if req.GetStagingTargetPath() == "" && !ephemeral {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	// Only the modes ValidateVolumeCapabilities confirms can be published;
+	// reader modes are then mounted read-only by publishReadOnly.
+	if mode := req.GetVolumeCapability().GetAccessMode().GetMode(); !supportedAccessMode(mode) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported access mode %s", mode)
+	}
+	if err := s.d.validateParameters("volume context", req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if ephemeral {
+		return s.publishEphemeral(req)
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return s.publishBlock(ctx, req)
+	}
+	stagingPath := req.GetStagingTargetPath()
+	targetPath := req.GetTargetPath()
+
+	mounts, err := readMountInfo(s.d.opts.MountInfoPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+	}
+	// Binding an unstaged (empty) staging directory would hand the pod an
+	// empty volume without any error.
+	if _, ok := findMount(mounts, stagingPath); !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "staging path %q is not mounted; call NodeStageVolume first", stagingPath)
 	}
 
 	// The target path is the directory inside the pod where the volume appears.
-	if err := os.MkdirAll(targetPath, 0750); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create target dir %q: %v", targetPath, err)
+	if err := ensureTarget(targetPath, true); err != nil {
+		return nil, err
+	}
+
+	// Two volumes published to one target would silently shadow each other.
+	if err := s.d.published.claim(targetPath, req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
+	// Kubelet retries publish after partial failures; if the target already
+	// shows the staged volume there is nothing left to do.
+	if isBindOf(mounts, targetPath, stagingPath) {
+		klog.V(4).Infof("NodePublishVolume: %q is already published at %q", stagingPath, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	flags := uintptr(syscall.MS_BIND)
-	if req.GetReadonly() {
+	readOnly, err := s.publishReadOnly(req)
+	if err != nil {
+		s.d.published.release(targetPath)
+		return nil, err
+	}
+	flags := mountFlags(req.GetVolumeCapability().GetMount().GetMountFlags())
+	if readOnly {
 		flags |= syscall.MS_RDONLY
 	}
+	if err := bindMount(stagingPath, targetPath, flags); err != nil {
+		s.d.published.release(targetPath)
+		return nil, err
+	}
+
+	klog.Infof("NodePublishVolume: id=%s staging=%s target=%s", req.GetVolumeId(), stagingPath, targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishReadOnly reports whether the volume must be published read-only:
+// because the CO asked for it or because the access mode only allows reading.
+// Mount flags asking for "rw" contradict that; the conflict is logged and
+// resolved by the ReadOnlyConflict policy.
+func (s *nodeServer) publishReadOnly(req *csi.NodePublishVolumeRequest) (bool, error) {
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	readOnly := req.GetReadonly() ||
+		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	if !readOnly {
+		return false, nil
+	}
+	for _, f := range req.GetVolumeCapability().GetMount().GetMountFlags() {
+		if f != "rw" {
+			continue
+		}
+		if s.d.opts.ReadOnlyConflict == ReadOnlyConflictError {
+			klog.Warningf("NodePublishVolume: id=%s: mount flag rw conflicts with read-only publish (readonly=%v, mode=%s), rejecting",
+				req.GetVolumeId(), req.GetReadonly(), mode)
+			return false, status.Errorf(codes.InvalidArgument, "mount flag rw conflicts with read-only publish (readonly=%v, access mode %s)",
+				req.GetReadonly(), mode)
+		}
+		klog.Warningf("NodePublishVolume: id=%s: mount flag rw conflicts with read-only publish (readonly=%v, mode=%s), mounting read-only",
+			req.GetVolumeId(), req.GetReadonly(), mode)
+		break
+	}
+	return true, nil
+}
+
+// checkStaleDevice returns nil if root, the root of a bind mount of a device
+// node, is a loop device that is either detached or attached to img, i.e. a
+// leftover of an earlier attachment of img. Otherwise it says what root is.
+func checkStaleDevice(root, img string) error {
+	if !strings.HasPrefix(filepath.Base(root), "loop") {
+		return errors.New("not a loop device")
+	}
+	backing, err := loopBackingFile(root)
+	if err != nil {
+		return err
+	}
+	if backing == "" || sameFile(backing, img) {
+		return nil
+	}
+	return fmt.Errorf("loop device backs %q", backing)
+}
+
+// sameFile reports whether paths a and b name the same existing file; the
+// kernel reports loop backing files by their resolved path.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// mountFlagBits maps the mount flags we honour to their MS_* bits. "rw" is
+// the default and needs none; publishReadOnly checks it against read-only
+// publishes.
+var mountFlagBits = map[string]uintptr{
+	"rw":       0,
+	"ro":       syscall.MS_RDONLY,
+	"noexec":   syscall.MS_NOEXEC,
+	"nosuid":   syscall.MS_NOSUID,
+	"nodev":    syscall.MS_NODEV,
+	"relatime": syscall.MS_RELATIME,
+}
+
+// mountFlags translates the capability's mount flags into MS_* bits.
+// Unrecognized flags are logged and ignored.
+func mountFlags(flags []string) uintptr {
+	var bits uintptr
+	for _, f := range flags {
+		b, ok := mountFlagBits[f]
+		if !ok {
+			klog.V(2).Infof("Ignoring unsupported mount flag %q", f)
+			continue
+		}
+		bits |= b
+	}
+	return bits
+}
+
+// publishBlock binds the loop device of a staged raw block volume to the
+// target path, which for block access is a file.
+func (s *nodeServer) publishBlock(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	meta, err := s.d.loadMeta(req.GetVolumeId())
+	if err != nil || meta.Backing != backingLoop || meta.FSType != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is not a raw block volume", req.GetVolumeId())
+	}
+	img := s.d.imagePath(req.GetVolumeId())
+	devs, err := loopDevices(ctx, img)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up loop device of %q: %v", img, err)
+	}
+	if len(devs) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s has no loop device; call NodeStageVolume first", req.GetVolumeId())
+	}
+	dev := devs[0]
+
+	if err := ensureTarget(targetPath, false); err != nil {
+		return nil, err
+	}
+	if err := s.d.published.claim(targetPath, req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
+	mounts, err := readMountInfo(s.d.opts.MountInfoPath)
+	if err != nil {
+		s.d.published.release(targetPath)
+		return nil, status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+	}
+	// A retry after a crash can find the device bound already, or the target
+	// still bound to the device of an earlier attachment of the image (the
+	// loop device changes when it is detached and staged again). The first
+	// is done; the second is unbound so the current device can be bound.
+	// Anything else at the target, including a loop device that now backs
+	// another file, is left alone.
+	for _, d := range devs {
+		if isBindOf(mounts, targetPath, d) {
+			klog.V(4).Infof("NodePublishVolume: %q is already published at %q", d, targetPath)
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+	}
+	if m, ok := findMount(mounts, targetPath); ok {
+		if err := checkStaleDevice(m.Root, img); err != nil {
+			s.d.published.release(targetPath)
+			return nil, status.Errorf(codes.AlreadyExists, "target %q is already mounted from %q: %v", targetPath, m.Root, err)
+		}
+		klog.Warningf("NodePublishVolume: %q is bound to stale device %s, rebinding to %s", targetPath, m.Root, dev)
+		if err := syscall.Unmount(targetPath, 0); err != nil {
+			s.d.published.release(targetPath)
+			return nil, fsError(err, "failed to unmount stale device from %q", targetPath)
+		}
+	}
 
-	if err := syscall.Mount(volumeDir, targetPath, "", flags, ""); err != nil {
-		return nil, status.Errorf(codes.Internal, "bind mount %q → %q failed: %v", volumeDir, targetPath, err)
+	readOnly, err := s.publishReadOnly(req)
+	if err != nil {
+		s.d.published.release(targetPath)
+		return nil, err
+	}
+	var flags uintptr
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := bindMount(dev, targetPath, flags); err != nil {
+		s.d.published.release(targetPath)
+		return nil, err
 	}
 
-	klog.Infof("NodePublishVolume: id=%s src=%s target=%s", req.GetVolumeId(), volumeDir, targetPath)
+	klog.Infof("NodePublishVolume: id=%s device=%s target=%s", req.GetVolumeId(), dev, targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// ensureTarget makes sure the target path exists with the type the access
+// type needs: a directory for mount access, a file for block access. Kubelet
+// sometimes pre-creates the wrong one; an empty one is replaced, anything
+// else is rejected with InvalidArgument.
+func ensureTarget(path string, dir bool) error {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fsError(err, "failed to stat target %q", path)
+	case fi.IsDir() == dir:
+		return nil
+	default:
+		if err := os.Remove(path); err != nil {
+			// A non-empty directory fails to be removed; so does a mount
+			// point.
+			return status.Errorf(codes.InvalidArgument, "target %q has the wrong type (%s) and cannot be replaced: %v",
+				path, fi.Mode().Type(), err)
+		}
+		klog.Warningf("Replaced target %q of the wrong type (%s)", path, fi.Mode().Type())
+	}
+
+	if dir {
+		if err := os.MkdirAll(path, 0750); err != nil {
+			return fsError(err, "failed to create target dir %q", path)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fsError(err, "failed to create target parent dir %q", filepath.Dir(path))
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0640)
+	if err != nil {
+		return fsError(err, "failed to create target file %q", path)
+	}
+	return f.Close()
+}
+
+// bindMount bind-mounts src at target with the extra mount flags.
+func bindMount(src, target string, flags uintptr) error {
+	if err := mountSyscall(src, target, "", syscall.MS_BIND, ""); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			return status.Errorf(codes.FailedPrecondition, "bind mount %q → %q failed: %v", src, target, errNoMountPermission)
+		}
+		return fsError(err, "bind mount %q → %q failed", src, target)
+	}
+	if flags == 0 {
+		return nil
+	}
+	// The kernel ignores all other flags when a bind mount is created; they
+	// only take effect on a remount of it.
+	if err := mountSyscall("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|flags, ""); err != nil {
+		if uerr := syscall.Unmount(target, 0); uerr != nil {
+			klog.Errorf("Failed to undo bind mount of %q after remount failure: %v", target, uerr)
+		}
+		return fsError(err, "failed to apply mount flags %#x to %q", flags, target)
+	}
+	return nil
+}
+
+// mountGroup returns the pod's fsGroup that should be applied to the volume,
+// if any. Kubelet only sends VolumeMountGroup when we advertise
+// VOLUME_MOUNT_GROUP, and in that case leaves the ownership change to us; we
+// apply it according to the configured fsGroupPolicy.
+func (s *nodeServer) mountGroup(cap *csi.VolumeCapability) (int, bool, error) {
+	group := cap.GetMount().GetVolumeMountGroup()
+	if group == "" {
+		return 0, false, nil
+	}
+	switch s.d.opts.FSGroupPolicy {
+	case FSGroupPolicyNone:
+		return 0, false, nil
+	case FSGroupPolicyReadWriteOnceWithFSType:
+		if cap.GetMount().GetFsType() == "" ||
+			cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+			return 0, false, nil
+		}
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return 0, false, status.Errorf(codes.InvalidArgument, "invalid volume mount group %q", group)
+	}
+	return gid, true, nil
+}
+
+// applyGroup gives gid ownership of everything under dir, the same way
+// kubelet would for fsGroup: group-owned, and the top directory group-writable
+// with setgid so new files inherit the group.
+func applyGroup(dir string, gid int) error {
+	err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, -1, gid)
+	})
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, fi.Mode().Perm()|0070|os.ModeSetgid)
+}
+
+// findEscapingSymlink walks dir and returns the first symlink whose target
+// lies outside dir, or "" if there is none. Targets are resolved lexically
+// relative to the link's directory; absolute targets only pass if they point
+// back into dir.
+func findEscapingSymlink(dir string) (string, error) {
+	var found string
+	err := filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		rel, err := filepath.Rel(dir, filepath.Clean(target))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			found = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
+
+// volumeSource resolves the host directory backing volumeID. When the
+// PublishContext carries publishContextVolumePath it must name that very
+// directory, stateDir/<volumeID>: any other path, even inside stateDir, would
+// let a request for one volume mount another volume, an image or a temporary
+// copy. Without the key (attachRequired: false, so there is no
+// ControllerPublishVolume call) we use stateDir/<volumeID> directly.
+func (s *nodeServer) volumeSource(volumeID string, publishContext map[string]string) (string, error) {
+	want := filepath.Join(s.d.stateDir, volumeID)
+	p, ok := publishContext[publishContextVolumePath]
+	if !ok {
+		return want, nil
+	}
+	if !filepath.IsAbs(p) {
+		return "", status.Errorf(codes.InvalidArgument, "publish context %s=%q is not an absolute path", publishContextVolumePath, p)
+	}
+	if filepath.Clean(p) != want {
+		return "", status.Errorf(codes.InvalidArgument, "publish context %s=%q is not the directory of volume %s", publishContextVolumePath, p, volumeID)
+	}
+	return want, nil
+}
+
 // NodeUnpublishVolume unmounts the bind mount created by NodePublishVolume.
 // It is idempotent: if the path is not mounted (EINVAL) we treat it as success.
-func (s *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+func (s *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if !s.d.nodeReady.Load() {
+		return nil, status.Error(codes.Unavailable, "node is still reconciling existing mounts")
+	}
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
 	if req.GetTargetPath() == "" {
 		return nil, status.Error(codes.InvalidArgument, "target path is required")
 	}
 
+	defer s.d.unpublishing.begin(req.GetVolumeId())()
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	targetPath := req.GetTargetPath()
 
+	if s.d.opts.StrictUnpublish {
+		if err := s.d.checkMountedVolume(ctx, req.GetVolumeId(), targetPath); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := syscall.Unmount(targetPath, 0); err != nil {
 		// EINVAL means the path is not mounted — already unpublished, which is fine.
 		if err == syscall.EINVAL {
 			klog.V(4).Infof("NodeUnpublishVolume: %q is not mounted, skipping", targetPath)
+			s.d.published.release(targetPath)
+			// A retry may find the unmount done but the ephemeral volume
+			// not yet deleted.
+			if err := s.d.removeEphemeral(req.GetVolumeId()); err != nil {
+				return nil, err
+			}
 			return &csi.NodeUnpublishVolumeResponse{}, nil
 		}
-		return nil, status.Errorf(codes.Internal, "unmount %q failed: %v", targetPath, err)
+		return nil, fsError(err, "unmount %q failed", targetPath)
+	}
+	if err := s.d.waitUnmounted(targetPath, s.d.opts.UnmountVerifyRetries); err != nil {
+		return nil, err
+	}
+	s.d.published.release(targetPath)
+	if err := s.d.removeEphemeral(req.GetVolumeId()); err != nil {
+		return nil, err
 	}
 
 	klog.Infof("NodeUnpublishVolume: id=%s target=%s", req.GetVolumeId(), targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-// NodeGetCapabilities reports which optional node-side capabilities we support.
-// We keep this simple: no STAGE_UNSTAGE_VOLUME, no expansion, no stats.
+// checkMountedVolume verifies that the mount at targetPath, if any, is one
+// of volumeID. A path that is not mounted passes, so that unpublish stays
+// idempotent.
+func (d *Driver) checkMountedVolume(ctx context.Context, volumeID, targetPath string) error {
+	mounts, err := readMountInfo(d.opts.MountInfoPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+	}
+	m, ok := findMount(mounts, targetPath)
+	if !ok {
+		return nil
+	}
+	if !d.isVolumeMount(ctx, volumeID, m) {
+		klog.Warningf("NodeUnpublishVolume: %q is mounted from %s:%s, not volume %s", targetPath, m.Source, m.Root, volumeID)
+		return status.Errorf(codes.FailedPrecondition, "target %q is mounted from %s:%s, which is not volume %s",
+			targetPath, m.Source, m.Root, volumeID)
+	}
+	return nil
+}
+
+// isVolumeMount reports whether m mounts volumeID: a bind of its directory, a
+// bind of the loop filesystem staged from its image (those have the loop
+// device as source and "/" as root) or a bind of its loop device node.
+func (d *Driver) isVolumeMount(ctx context.Context, volumeID string, m mountInfo) bool {
+	if isLoopDevice(m.Source) {
+		backing, err := loopBackingFile(m.Source)
+		return err == nil && backing != "" && sameFile(backing, d.imagePath(volumeID))
+	}
+	return filepath.Base(m.Root) == volumeID || d.isVolumeDevice(ctx, volumeID, m.Root)
+}
+
+// isVolumeDevice reports whether root, the root of a bind mount of a device
+// node, names a loop device attached to volumeID's image.
+func (d *Driver) isVolumeDevice(ctx context.Context, volumeID, root string) bool {
+	devs, err := loopDevices(ctx, d.imagePath(volumeID))
+	if err != nil {
+		return false
+	}
+	for _, dev := range devs {
+		if filepath.Base(dev) == filepath.Base(root) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitUnmounted re-reads the mount table up to retries times, backing off
+// between attempts, until targetPath is no longer a mount point.
+func (d *Driver) waitUnmounted(targetPath string, retries int) error {
+	if retries == 0 {
+		return nil
+	}
+	delay := 100 * time.Millisecond
+	for i := 0; i < retries; i++ {
+		mounts, err := readMountInfo(d.opts.MountInfoPath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read mount table: %v", err)
+		}
+		if _, mounted := findMount(mounts, targetPath); !mounted {
+			return nil
+		}
+		klog.V(4).Infof("NodeUnpublishVolume: %q still mounted, re-checking in %v", targetPath, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return status.Errorf(codes.Internal, "%q is still mounted after unmount", targetPath)
+}
+
+// NodeGetVolumeStats reports usage for a published volume path. Hostpath
+// volumes share the backing filesystem, so total and available space are
+// those of that filesystem; the used numbers come from walking the volume,
+// bounded by VolumeStatsTimeout. If the walk is disabled or times out we fall
+// back to the filesystem-wide numbers and say so in the volume condition.
+func (s *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(req.GetVolumePath(), &st); err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return nil, status.Errorf(codes.NotFound, "volume path %q does not exist", req.GetVolumePath())
+		}
+		return nil, fsError(err, "statfs %q failed", req.GetVolumePath())
+	}
+
+	bsize := int64(st.Bsize)
+	bytes := &csi.VolumeUsage{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     int64(st.Blocks) * bsize,
+		Available: int64(st.Bavail) * bsize,
+		Used:      int64(st.Blocks-st.Bfree) * bsize,
+	}
+	inodes := &csi.VolumeUsage{
+		Unit:      csi.VolumeUsage_INODES,
+		Total:     int64(st.Files),
+		Available: int64(st.Ffree),
+		Used:      int64(st.Files - st.Ffree),
+	}
+	resp := &csi.NodeGetVolumeStatsResponse{Usage: []*csi.VolumeUsage{bytes, inodes}}
+
+	if timeout := s.d.opts.VolumeStatsTimeout; timeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		usedBytes, usedInodes, err := diskUsage(ctx, req.GetVolumePath())
+		switch {
+		case err == nil:
+			bytes.Used, inodes.Used = usedBytes, usedInodes
+		case ctx.Err() != nil:
+			klog.Warningf("NodeGetVolumeStats: id=%s: usage walk timed out after %v, reporting filesystem usage", req.GetVolumeId(), timeout)
+			resp.VolumeCondition = &csi.VolumeCondition{Message: "usage computation timed out; reporting filesystem usage"}
+		default:
+			return nil, fsError(err, "failed to compute usage of %q", req.GetVolumePath())
+		}
+	}
+	return resp, nil
+}
+
+// diskUsage walks dir and returns the bytes allocated to it and the number of
+// inodes it uses. It gives up when ctx is done; the walk itself runs in the
+// background so that a stuck syscall cannot block the caller.
+func diskUsage(ctx context.Context, dir string) (int64, int64, error) {
+	type result struct {
+		bytes, inodes int64
+		err           error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		r.err = filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fi, err := de.Info()
+			if err != nil {
+				return err
+			}
+			r.inodes++
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				r.bytes += st.Blocks * 512
+			}
+			return nil
+		})
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.bytes, r.inodes, r.err
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+}
+
+// NodeGetCapabilities reports which optional node-side capabilities we support:
+// staging, volume stats and conditions, and expansion (for loop-backed
+// volumes). VOLUME_MOUNT_GROUP is advertised unless fsGroupPolicy is None.
 func (s *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	caps := []*csi.NodeServiceCapability{
+		nodeCapability(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME),
+		nodeCapability(csi.NodeServiceCapability_RPC_GET_VOLUME_STATS),
+		nodeCapability(csi.NodeServiceCapability_RPC_VOLUME_CONDITION),
+		nodeCapability(csi.NodeServiceCapability_RPC_EXPAND_VOLUME),
+	}
+	if s.d.opts.FSGroupPolicy != FSGroupPolicyNone {
+		caps = append(caps, nodeCapability(csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP))
+	}
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{},
+		Capabilities: caps,
 	}, nil
 }
 
-// NodeGetInfo returns the node ID that the driver was started with.
-// The external-provisioner uses this to set node affinity on PVs.
+// NodeExpandVolume completes an expansion on the node. Directory volumes have
+// nothing to grow. For loop-backed volumes, whose image ControllerExpandVolume
+// already grew, the loop device is refreshed and a filesystem on it is grown
+// online.
+func (s *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if !s.d.nodeReady.Load() {
+		return nil, status.Error(codes.Unavailable, "node is still reconciling existing mounts")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := validateID("volume ID", req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
+	}
+	unlock, err := s.d.volumeLocks.lock(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta, err := s.d.loadMeta(req.GetVolumeId())
+	switch {
+	case os.IsNotExist(err):
+		if _, serr := os.Stat(filepath.Join(s.d.stateDir, req.GetVolumeId())); os.IsNotExist(serr) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+		}
+		meta = &volumeMeta{}
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to load metadata for volume %s: %v", req.GetVolumeId(), err)
+	}
+	if meta.Backing != backingLoop {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+
+	// xfs_growfs needs the mount point; the staging path is the volume's
+	// own mount, the volume path a bind of it.
+	mountPath := req.GetStagingTargetPath()
+	if mountPath == "" {
+		mountPath = req.GetVolumePath()
+	}
+	img := s.d.imagePath(req.GetVolumeId())
+	if err := growLoop(ctx, img, meta.FSType, mountPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to expand volume %s: %v", req.GetVolumeId(), err)
+	}
+	fi, err := os.Stat(img)
+	if err != nil {
+		return nil, fsError(err, "failed to stat image %q", img)
+	}
+	klog.Infof("NodeExpandVolume: id=%s capacity=%d", req.GetVolumeId(), fi.Size())
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: fi.Size()}, nil
+}
+
+func nodeCapability(t csi.NodeServiceCapability_RPC_Type) *csi.NodeServiceCapability {
+	return &csi.NodeServiceCapability{
+		Type: &csi.NodeServiceCapability_Rpc{
+			Rpc: &csi.NodeServiceCapability_RPC{Type: t},
+		},
+	}
+}
+
+// NodeGetInfo returns the node ID that the driver was started with and the
+// node's topology segment. The external-provisioner uses these to set node
+// affinity on PVs.
 func (s *nodeServer) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	return &csi.NodeGetInfoResponse{
-		NodeId: s.d.nodeID,
+		NodeId:             s.d.nodeID,
+		MaxVolumesPerNode:  int64(s.d.opts.MaxVolumesPerNode),
+		AccessibleTopology: s.d.nodeTopology(),
 	}, nil
 }
@@ -0,0 +1,824 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+func TestNodePublishVolumeAlreadyMounted(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	target := filepath.Join(dir, "target")
+
+	// The fake mount table shows the volume staged and already bound at the
+	// target, as after a publish whose response kubelet never received.
+	mountInfo := filepath.Join(dir, "mountinfo")
+	table := fmt.Sprintf(`1 0 8:1 / / rw - ext4 /dev/sda1 rw
+2 1 8:1 /var/lib/demo/vol-1 %s rw - ext4 /dev/sda1 rw
+3 1 8:1 /var/lib/demo/vol-1 %s rw - ext4 /dev/sda1 rw
+`, staging, target)
+	if err := os.WriteFile(mountInfo, []byte(table), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(t, Options{MountInfoPath: mountInfo})
+	ns := &nodeServer{d: d}
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+
+	// Nothing in the fake table is really mounted, so had the publish
+	// mounted again the target would show up in the real mount table.
+	mounts, err := readMountInfo(defaultMountInfoPath)
+	if err != nil {
+		t.Fatalf("readMountInfo: %v", err)
+	}
+	if m, ok := findMount(mounts, target); ok {
+		t.Errorf("target was mounted again: %+v", m)
+	}
+	if got := d.published.list(); len(got) != 1 || got[0].VolumeID != "vol-1" {
+		t.Errorf("published targets = %v, want vol-1 at %s", got, target)
+	}
+}
+
+func TestPublishReadOnly(t *testing.T) {
+	tests := []struct {
+		mode     csi.VolumeCapability_AccessMode_Mode
+		readonly bool
+		want     bool
+	}{
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, want: false},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, readonly: true, want: true},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, want: true},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, want: true},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, readonly: true, want: true},
+	}
+	ns := &nodeServer{d: newTestDriver(t, Options{})}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/readonly=%t", tt.mode, tt.readonly), func(t *testing.T) {
+			capability := mountCapability()
+			capability.AccessMode.Mode = tt.mode
+			got, err := ns.publishReadOnly(&csi.NodePublishVolumeRequest{
+				VolumeId:         "vol-1",
+				VolumeCapability: capability,
+				Readonly:         tt.readonly,
+			})
+			if err != nil {
+				t.Fatalf("publishReadOnly: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("publishReadOnly = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishReadOnlyConflict(t *testing.T) {
+	rox := csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	rwo := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	tests := []struct {
+		name     string
+		policy   string
+		mode     csi.VolumeCapability_AccessMode_Mode
+		readonly bool
+		want     bool
+		wantCode codes.Code
+		wantLog  string
+	}{
+		{name: "readonly-wins, read-only mode", policy: ReadOnlyConflictReadOnlyWins, mode: rox, want: true, wantLog: "mounting read-only"},
+		{name: "readonly-wins, readonly flag", policy: ReadOnlyConflictReadOnlyWins, mode: rwo, readonly: true, want: true, wantLog: "mounting read-only"},
+		{name: "error, read-only mode", policy: ReadOnlyConflictError, mode: rox, wantCode: codes.InvalidArgument, wantLog: "rejecting"},
+		{name: "error, writable publish", policy: ReadOnlyConflictError, mode: rwo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureKlog(t)
+			ns := &nodeServer{d: newTestDriver(t, Options{ReadOnlyConflict: tt.policy})}
+			capability := mountCapability()
+			capability.AccessMode.Mode = tt.mode
+			capability.GetMount().MountFlags = []string{"noexec", "rw"}
+			got, err := ns.publishReadOnly(&csi.NodePublishVolumeRequest{
+				VolumeId:         "vol-1",
+				VolumeCapability: capability,
+				Readonly:         tt.readonly,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("publishReadOnly: got %v, want %v", err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("publishReadOnly = %t, want %t", got, tt.want)
+			}
+			klog.Flush()
+			out := logs.String()
+			if tt.wantLog == "" {
+				if strings.Contains(out, "conflicts") {
+					t.Errorf("conflict logged for a writable publish:\n%s", out)
+				}
+			} else if !strings.Contains(out, "conflicts with read-only publish") || !strings.Contains(out, tt.wantLog) {
+				t.Errorf("conflict not logged with %q in:\n%s", tt.wantLog, out)
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnknownReadOnlyConflict(t *testing.T) {
+	if _, err := New("test-node", t.TempDir(), Options{ReadOnlyConflict: "rw-wins"}); err == nil {
+		t.Error("New accepted an unknown read-only conflict policy")
+	}
+}
+
+func TestMountFlags(t *testing.T) {
+	tests := []struct {
+		flags []string
+		want  uintptr
+	}{
+		{flags: nil, want: 0},
+		{flags: []string{"noexec", "nosuid"}, want: syscall.MS_NOEXEC | syscall.MS_NOSUID},
+		{flags: []string{"ro", "nodev", "relatime"}, want: syscall.MS_RDONLY | syscall.MS_NODEV | syscall.MS_RELATIME},
+		// rw is the default, and unknown flags are ignored.
+		{flags: []string{"rw", "noatime=bogus", "noexec"}, want: syscall.MS_NOEXEC},
+	}
+	for _, tt := range tests {
+		if got := mountFlags(tt.flags); got != tt.want {
+			t.Errorf("mountFlags(%q) = %#x, want %#x", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestNodePublishVolumeUnsupportedAccessMode(t *testing.T) {
+	ns := &nodeServer{d: newTestDriver(t, Options{})}
+	for _, mode := range []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_UNKNOWN,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	} {
+		capability := mountCapability()
+		capability.AccessMode.Mode = mode
+		dir := t.TempDir()
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-1",
+			StagingTargetPath: filepath.Join(dir, "staging"),
+			TargetPath:        filepath.Join(dir, "target"),
+			VolumeCapability:  capability,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("NodePublishVolume with %s: got %v, want InvalidArgument", mode, err)
+		}
+	}
+}
+
+// realSysBlockDir is sysBlockDir before any test replaces it.
+var realSysBlockDir = sysBlockDir
+
+// fakeLoopDevice makes loopBackingFile report that loop device name is
+// attached to backing, by pointing sysBlockDir at a fake sysfs. Devices faked
+// in the same test share one fake sysfs.
+func fakeLoopDevice(t *testing.T, name, backing string) {
+	t.Helper()
+	if sysBlockDir == realSysBlockDir {
+		sysBlockDir = t.TempDir()
+		t.Cleanup(func() { sysBlockDir = realSysBlockDir })
+	}
+	dir := filepath.Join(sysBlockDir, name, "loop")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "backing_file"), []byte(backing+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeMountInfo writes lines as a mountinfo file and returns its path.
+func writeMountInfo(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckMountedVolume(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+	tests := []struct {
+		name     string
+		mount    string
+		volumeID string
+		wantCode codes.Code
+	}{
+		{name: "not mounted", volumeID: "vol-1", wantCode: codes.OK},
+		{name: "directory bind", mount: "/var/lib/demo/vol-1", volumeID: "vol-1", wantCode: codes.OK},
+		{name: "directory bind of another volume", mount: "/var/lib/demo/vol-2", volumeID: "vol-1", wantCode: codes.FailedPrecondition},
+		{name: "loop filesystem", mount: "loop", volumeID: "vol-1", wantCode: codes.OK},
+		{name: "loop filesystem of another volume", mount: "loop", volumeID: "vol-2", wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []string{"1 0 8:1 / / rw - ext4 /dev/sda1 rw"}
+			switch tt.mount {
+			case "":
+			case "loop":
+				lines = append(lines, "2 1 7:7 / "+target+" rw - ext4 /dev/loop7 rw")
+			default:
+				lines = append(lines, "2 1 8:1 "+tt.mount+" "+target+" rw - ext4 /dev/sda1 rw")
+			}
+			d := newTestDriver(t, Options{MountInfoPath: writeMountInfo(t, lines...), StrictUnpublish: true})
+			for _, id := range []string{"vol-1", "vol-2"} {
+				if err := os.WriteFile(d.imagePath(id), nil, 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fakeLoopDevice(t, "loop7", d.imagePath("vol-1"))
+
+			err := d.checkMountedVolume(context.Background(), tt.volumeID, target)
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("checkMountedVolume: got %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+// requireMounts skips tests that really mount, which needs CAP_SYS_ADMIN.
+func requireMounts(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+}
+
+func TestVolumeSource(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	ns := &nodeServer{d: d}
+	volumeDir := filepath.Join(d.stateDir, "vol-1")
+	tests := []struct {
+		name     string
+		context  map[string]string
+		wantCode codes.Code
+	}{
+		{name: "absent", wantCode: codes.OK},
+		{name: "volume dir", context: map[string]string{publishContextVolumePath: volumeDir}, wantCode: codes.OK},
+		{name: "unclean volume dir", context: map[string]string{publishContextVolumePath: volumeDir + "/"}, wantCode: codes.OK},
+		{name: "relative", context: map[string]string{publishContextVolumePath: "vol-1"}, wantCode: codes.InvalidArgument},
+		{name: "another volume", context: map[string]string{publishContextVolumePath: filepath.Join(d.stateDir, "vol-2")}, wantCode: codes.InvalidArgument},
+		{name: "image", context: map[string]string{publishContextVolumePath: d.imagePath("vol-1")}, wantCode: codes.InvalidArgument},
+		{name: "state dir", context: map[string]string{publishContextVolumePath: d.stateDir}, wantCode: codes.InvalidArgument},
+		{name: "outside", context: map[string]string{publishContextVolumePath: "/etc"}, wantCode: codes.InvalidArgument},
+		{name: "escaping", context: map[string]string{publishContextVolumePath: filepath.Join(d.stateDir, "..", "vol-1")}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ns.volumeSource("vol-1", tt.context)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("volumeSource: got %v, want %v", err, tt.wantCode)
+			}
+			if err == nil && got != volumeDir {
+				t.Errorf("volumeSource = %q, want %q", got, volumeDir)
+			}
+		})
+	}
+}
+
+func TestPublishContextRoundTrip(t *testing.T) {
+	requireMounts(t)
+	d := newTestDriver(t, Options{})
+	cs, ns := &controllerServer{d: d}, &nodeServer{d: d}
+	ctx := context.Background()
+	if _, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	}); err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	dir := t.TempDir()
+	staging, target := filepath.Join(dir, "staging"), filepath.Join(dir, "target")
+	publishContext := map[string]string{publishContextVolumePath: filepath.Join(d.stateDir, "vol-1")}
+	if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+		PublishContext:    publishContext,
+	}); err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	t.Cleanup(func() {
+		ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1", StagingTargetPath: staging})
+	})
+	if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+		PublishContext:    publishContext,
+	}); err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	t.Cleanup(func() {
+		ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: target})
+	})
+
+	if err := os.WriteFile(filepath.Join(target, "data"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.stateDir, "vol-1", "data")); err != nil {
+		t.Errorf("file written in the pod is not in the volume dir: %v", err)
+	}
+}
+
+func TestNodeGetVolumeStatsTimeout(t *testing.T) {
+	volumePath := t.TempDir()
+	for i := 0; i < 100; i++ {
+		if err := os.WriteFile(filepath.Join(volumePath, fmt.Sprint(i)), []byte("data"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: volumePath}
+
+	// A walk that cannot finish in time falls back to filesystem usage.
+	ns := &nodeServer{d: newTestDriver(t, Options{VolumeStatsTimeout: time.Nanosecond})}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %v", err)
+	}
+	if msg := resp.GetVolumeCondition().GetMessage(); !strings.Contains(msg, "timed out") {
+		t.Errorf("volume condition = %q, want a timeout notice", msg)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &st); err != nil {
+		t.Fatal(err)
+	}
+	if total := int64(st.Blocks) * int64(st.Bsize); resp.GetUsage()[0].GetTotal() != total {
+		t.Errorf("total bytes = %d, want the filesystem's %d", resp.GetUsage()[0].GetTotal(), total)
+	}
+
+	// One that finishes reports the volume's own usage.
+	ns = &nodeServer{d: newTestDriver(t, Options{VolumeStatsTimeout: time.Minute})}
+	resp, err = ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %v", err)
+	}
+	if resp.GetVolumeCondition() != nil {
+		t.Errorf("volume condition = %v, want none", resp.GetVolumeCondition())
+	}
+	if inodes := resp.GetUsage()[1].GetUsed(); inodes != 101 {
+		t.Errorf("used inodes = %d, want 101 (the directory and its files)", inodes)
+	}
+}
+
+func TestEnsureTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // "", "dir", "file" or "nonempty-dir"
+		dir      bool
+		wantCode codes.Code
+	}{
+		{name: "mount, missing", dir: true},
+		{name: "mount, directory", existing: "dir", dir: true},
+		{name: "mount, empty file", existing: "file", dir: true},
+		{name: "block, missing"},
+		{name: "block, file", existing: "file"},
+		{name: "block, empty directory", existing: "dir"},
+		{name: "block, non-empty directory", existing: "nonempty-dir", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pod", "target")
+			if tt.existing != "" {
+				if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+					t.Fatal(err)
+				}
+			}
+			switch tt.existing {
+			case "dir":
+				if err := os.Mkdir(path, 0750); err != nil {
+					t.Fatal(err)
+				}
+			case "file":
+				if err := os.WriteFile(path, nil, 0640); err != nil {
+					t.Fatal(err)
+				}
+			case "nonempty-dir":
+				if err := os.MkdirAll(filepath.Join(path, "data"), 0750); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := ensureTarget(path, tt.dir)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ensureTarget: got %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("target: %v", err)
+			}
+			if tt.dir && !fi.IsDir() {
+				t.Errorf("mount target is %s, want a directory", fi.Mode().Type())
+			}
+			if !tt.dir && !fi.Mode().IsRegular() {
+				t.Errorf("block target is %s, want a regular file", fi.Mode().Type())
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolumeStrict(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+	if err := os.Mkdir(target, 0750); err != nil {
+		t.Fatal(err)
+	}
+	// The fake table shows vol-2 at target; the real one shows nothing, so
+	// an unpublish that gets past the check finds target not mounted.
+	mountInfoPath := writeMountInfo(t,
+		"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+		"2 1 8:1 /var/lib/demo/vol-2 "+target+" rw - ext4 /dev/sda1 rw",
+	)
+	tests := []struct {
+		name     string
+		strict   bool
+		volumeID string
+		wantCode codes.Code
+	}{
+		{name: "strict, mismatched ID", strict: true, volumeID: "vol-1", wantCode: codes.FailedPrecondition},
+		{name: "strict, matching ID", strict: true, volumeID: "vol-2"},
+		{name: "lenient, mismatched ID", volumeID: "vol-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDriver(t, Options{MountInfoPath: mountInfoPath, StrictUnpublish: tt.strict})
+			_, err := (&nodeServer{d: d}).NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   tt.volumeID,
+				TargetPath: target,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("NodeUnpublishVolume: got %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFSGroupPolicy(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to change group ownership")
+	}
+	const gid = 4242
+	withGroup := func(fsType string, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		c := mountCapability()
+		c.GetMount().FsType = fsType
+		c.GetMount().VolumeMountGroup = fmt.Sprint(gid)
+		c.AccessMode.Mode = mode
+		return c
+	}
+	rwo := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	rox := csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	tests := []struct {
+		name      string
+		policy    string
+		cap       *csi.VolumeCapability
+		wantChown bool
+	}{
+		{name: "File", policy: FSGroupPolicyFile, cap: withGroup("", rox), wantChown: true},
+		{name: "ReadWriteOnceWithFSType, RWO with fsType", policy: FSGroupPolicyReadWriteOnceWithFSType, cap: withGroup("ext4", rwo), wantChown: true},
+		{name: "ReadWriteOnceWithFSType, no fsType", policy: FSGroupPolicyReadWriteOnceWithFSType, cap: withGroup("", rwo)},
+		{name: "ReadWriteOnceWithFSType, read-only", policy: FSGroupPolicyReadWriteOnceWithFSType, cap: withGroup("ext4", rox)},
+		{name: "None", policy: FSGroupPolicyNone, cap: withGroup("ext4", rwo)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := &nodeServer{d: newTestDriver(t, Options{FSGroupPolicy: tt.policy})}
+			dir := t.TempDir()
+			file := filepath.Join(dir, "data")
+			if err := os.WriteFile(file, nil, 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := ns.prepareContent(&csi.NodeStageVolumeRequest{VolumeId: "vol-1", VolumeCapability: tt.cap}, dir); err != nil {
+				t.Fatalf("prepareContent: %v", err)
+			}
+			for _, p := range []string{dir, file} {
+				fi, err := os.Stat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if chowned := fi.Sys().(*syscall.Stat_t).Gid == gid; chowned != tt.wantChown {
+					t.Errorf("%s owned by group %d: chowned=%t, want %t", p, fi.Sys().(*syscall.Stat_t).Gid, chowned, tt.wantChown)
+				}
+			}
+
+			caps, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+			if err != nil {
+				t.Fatalf("NodeGetCapabilities: %v", err)
+			}
+			advertised := false
+			for _, c := range caps.GetCapabilities() {
+				advertised = advertised || c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP
+			}
+			if want := tt.policy != FSGroupPolicyNone; advertised != want {
+				t.Errorf("VOLUME_MOUNT_GROUP advertised=%t, want %t", advertised, want)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeSymlinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   func(volumeDir string) string
+		wantCode codes.Code
+	}{
+		{name: "relative, inside", target: func(string) string { return "data/file" }},
+		{name: "absolute, inside", target: func(dir string) string { return filepath.Join(dir, "data") }},
+		{name: "relative, escaping", target: func(string) string { return "../../vol-2" }, wantCode: codes.FailedPrecondition},
+		{name: "absolute, escaping", target: func(string) string { return "/etc/shadow" }, wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staging := filepath.Join(t.TempDir(), "staging")
+			d := newTestDriver(t, Options{RejectEscapingSymlinks: true})
+			createTestVolume(t, d, "vol-1")
+			volumeDir := filepath.Join(d.stateDir, "vol-1")
+			if err := os.MkdirAll(filepath.Join(volumeDir, "data"), 0750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(tt.target(volumeDir), filepath.Join(volumeDir, "data", "link")); err != nil {
+				t.Fatal(err)
+			}
+			// Show the volume staged already, so that a stage that passes the
+			// scan has nothing left to mount.
+			d.opts.MountInfoPath = writeMountInfo(t,
+				"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+				"2 1 8:1 "+volumeDir+" "+staging+" rw - ext4 /dev/sda1 rw",
+			)
+
+			_, err := (&nodeServer{d: d}).NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: staging,
+				VolumeCapability:  mountCapability(),
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("NodeStageVolume: got %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWaitUnmounted(t *testing.T) {
+	target := "/pods/a/vol"
+	root := "1 0 8:1 / / rw - ext4 /dev/sda1 rw"
+	lingering := "2 1 8:1 /var/lib/demo/vol-1 " + target + " rw - ext4 /dev/sda1 rw"
+
+	t.Run("clears after one retry", func(t *testing.T) {
+		path := writeMountInfo(t, root, lingering)
+		d := newTestDriver(t, Options{MountInfoPath: path})
+		// The mount goes away between the first check and the retry.
+		cleared := writeMountInfo(t, root)
+		timer := time.AfterFunc(20*time.Millisecond, func() { os.Rename(cleared, path) })
+		defer timer.Stop()
+		if err := d.waitUnmounted(target, 3); err != nil {
+			t.Errorf("waitUnmounted: %v", err)
+		}
+	})
+	t.Run("never clears", func(t *testing.T) {
+		d := newTestDriver(t, Options{MountInfoPath: writeMountInfo(t, root, lingering)})
+		if err := d.waitUnmounted(target, 2); status.Code(err) != codes.Internal {
+			t.Errorf("waitUnmounted: got %v, want Internal", err)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		d := newTestDriver(t, Options{MountInfoPath: writeMountInfo(t, root, lingering)})
+		if err := d.waitUnmounted(target, 0); err != nil {
+			t.Errorf("waitUnmounted with no retries: %v", err)
+		}
+	})
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns := &nodeServer{d: newTestDriver(t, Options{})}
+	volumePath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(volumePath, "data"), make([]byte, 8192), 0640); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: volumePath})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %v", err)
+	}
+	var bytes, inodes *csi.VolumeUsage
+	for _, u := range resp.GetUsage() {
+		switch u.GetUnit() {
+		case csi.VolumeUsage_BYTES:
+			bytes = u
+		case csi.VolumeUsage_INODES:
+			inodes = u
+		}
+	}
+	if bytes == nil || inodes == nil {
+		t.Fatalf("usage %v lacks bytes or inodes", resp.GetUsage())
+	}
+	if bytes.GetTotal() <= 0 || bytes.GetUsed() < 8192 || bytes.GetAvailable() > bytes.GetTotal() {
+		t.Errorf("byte usage = %v, want a non-zero total and at least 8192 used", bytes)
+	}
+	if inodes.GetTotal() <= 0 || inodes.GetUsed() <= 0 {
+		t.Errorf("inode usage = %v, want non-zero totals", inodes)
+	}
+
+	tests := []struct {
+		name     string
+		req      *csi.NodeGetVolumeStatsRequest
+		wantCode codes.Code
+	}{
+		{name: "no path", req: &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1"}, wantCode: codes.InvalidArgument},
+		{name: "missing path", req: &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: filepath.Join(volumePath, "gone")}, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		if _, err := ns.NodeGetVolumeStats(context.Background(), tt.req); status.Code(err) != tt.wantCode {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantCode)
+		}
+	}
+
+	caps, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetCapabilities: %v", err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		advertised = advertised || c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_GET_VOLUME_STATS
+	}
+	if !advertised {
+		t.Error("GET_VOLUME_STATS is not advertised")
+	}
+}
+
+func TestStagePublishLifecycle(t *testing.T) {
+	requireMounts(t)
+	d := newTestDriver(t, Options{})
+	ns := &nodeServer{d: d}
+	ctx := context.Background()
+	createTestVolume(t, d, "vol-1")
+	if err := os.WriteFile(filepath.Join(d.stateDir, "vol-1", "data"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	pods := t.TempDir()
+	staging := filepath.Join(pods, "staging")
+	target := filepath.Join(pods, "target")
+	visible := func(dir string) bool {
+		_, err := os.Stat(filepath.Join(dir, "data"))
+		return err == nil
+	}
+	t.Cleanup(func() {
+		// Leave nothing mounted if the test fails half-way.
+		syscall.Unmount(target, syscall.MNT_DETACH)
+		syscall.Unmount(staging, syscall.MNT_DETACH)
+	})
+
+	caps, err := ns.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetCapabilities: %v", err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		advertised = advertised || c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME
+	}
+	if !advertised {
+		t.Error("STAGE_UNSTAGE_VOLUME not advertised")
+	}
+
+	if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+	}); err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	if !visible(staging) {
+		t.Fatal("volume content not visible at the staging path")
+	}
+	if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+	}); err != nil {
+		t.Fatalf("NodePublishVolume: %v", err)
+	}
+	if !visible(target) {
+		t.Fatal("volume content not visible at the target path")
+	}
+
+	if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: target}); err != nil {
+		t.Fatalf("NodeUnpublishVolume: %v", err)
+	}
+	if visible(target) {
+		t.Error("volume content still visible at the target path after NodeUnpublishVolume")
+	}
+	if !visible(staging) {
+		t.Error("NodeUnpublishVolume also removed the staging mount")
+	}
+
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1", StagingTargetPath: staging}
+	if _, err := ns.NodeUnstageVolume(ctx, unstage); err != nil {
+		t.Fatalf("NodeUnstageVolume: %v", err)
+	}
+	if visible(staging) {
+		t.Error("volume content still visible at the staging path after NodeUnstageVolume")
+	}
+	if _, err := ns.NodeUnstageVolume(ctx, unstage); err != nil {
+		t.Errorf("repeated NodeUnstageVolume: %v", err)
+	}
+	if !visible(filepath.Join(d.stateDir, "vol-1")) {
+		t.Error("volume content lost after unstaging")
+	}
+}
+
+func TestNodeExpandVolumeDirectory(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	ns := &nodeServer{d: d}
+	ctx := context.Background()
+	createTestVolume(t, d, "vol-1")
+	expand := func(id string) (*csi.NodeExpandVolumeResponse, error) {
+		return ns.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+			VolumeId:      id,
+			VolumePath:    filepath.Join(t.TempDir(), "target"),
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 4 << 20},
+		})
+	}
+
+	resp, err := expand("vol-1")
+	if err != nil {
+		t.Fatalf("NodeExpandVolume: %v", err)
+	}
+	if resp.GetCapacityBytes() != 4<<20 {
+		t.Errorf("NodeExpandVolume capacity = %d, want %d", resp.GetCapacityBytes(), 4<<20)
+	}
+	if _, err := expand("vol-9"); status.Code(err) != codes.NotFound {
+		t.Errorf("NodeExpandVolume of a missing volume: got %v, want NotFound", err)
+	}
+
+	caps, err := ns.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetCapabilities: %v", err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		advertised = advertised || c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_EXPAND_VOLUME
+	}
+	if !advertised {
+		t.Error("EXPAND_VOLUME not advertised")
+	}
+}
+
+func TestNodeStageVolumeMissingDir(t *testing.T) {
+	tests := []struct {
+		name     string
+		assume   bool
+		wantCode codes.Code
+	}{
+		{name: "create if missing", assume: true},
+		{name: "fail if missing", wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staging := filepath.Join(t.TempDir(), "staging")
+			d := newTestDriver(t, Options{AssumeControllerCreated: tt.assume})
+			volumeDir := filepath.Join(d.stateDir, "vol-1")
+			// Show the volume staged already, so that a stage that gets past
+			// the directory check has nothing left to mount.
+			d.opts.MountInfoPath = writeMountInfo(t,
+				"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+				"2 1 8:1 "+volumeDir+" "+staging+" rw - ext4 /dev/sda1 rw",
+			)
+
+			_, err := (&nodeServer{d: d}).NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: staging,
+				VolumeCapability:  mountCapability(),
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("NodeStageVolume: got %v, want %v", err, tt.wantCode)
+			}
+			_, err = os.Stat(volumeDir)
+			if created := err == nil; created != tt.assume {
+				t.Errorf("volume dir created=%t, want %t", created, tt.assume)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// publishedTargets maps each target path the node plugin has published to
+// the ID of the volume mounted there.
+type publishedTargets struct {
+	mu      sync.Mutex
+	targets map[string]string
+	// maxVolumes caps the number of distinct volumes claim lets in; zero
+	// means no limit.
+	maxVolumes int
+}
+
+func newPublishedTargets(maxVolumes int) *publishedTargets {
+	return &publishedTargets{targets: make(map[string]string), maxVolumes: maxVolumes}
+}
+
+// claim records volumeID at target. It fails with FailedPrecondition if a
+// different volume already holds target, and with ResourceExhausted if
+// volumeID is not published yet and maxVolumes volumes already are.
+func (p *publishedTargets) claim(target, volumeID string) error {
+	target = filepath.Clean(target)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur, found := p.targets[target]; found {
+		if cur != volumeID {
+			return status.Errorf(codes.FailedPrecondition, "target %q is already used by volume %s", target, cur)
+		}
+		return nil
+	}
+	if p.maxVolumes > 0 {
+		volumes := make(map[string]bool)
+		for _, id := range p.targets {
+			volumes[id] = true
+		}
+		if !volumes[volumeID] && len(volumes) >= p.maxVolumes {
+			return status.Errorf(codes.ResourceExhausted, "node already has the maximum of %d volumes published", p.maxVolumes)
+		}
+	}
+	p.targets[target] = volumeID
+	return nil
+}
+
+// record is claim without the checks, for mounts that already exist.
+func (p *publishedTargets) record(target, volumeID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets[filepath.Clean(target)] = volumeID
+}
+
+// release forgets whatever volume is recorded at target.
+func (p *publishedTargets) release(target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.targets, filepath.Clean(target))
+}
+
+// publishedTarget is one entry of the /debug/volumes listing.
+type publishedTarget struct {
+	VolumeID string `json:"volumeId"`
+	Target   string `json:"target"`
+}
+
+// list returns the recorded targets sorted by volume ID, then target.
+func (p *publishedTargets) list() []publishedTarget {
+	p.mu.Lock()
+	out := make([]publishedTarget, 0, len(p.targets))
+	for target, id := range p.targets {
+		out = append(out, publishedTarget{VolumeID: id, Target: target})
+	}
+	p.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].VolumeID != out[j].VolumeID {
+			return out[i].VolumeID < out[j].VolumeID
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+// serveDebugVolumes writes the published targets as JSON. Per-volume state
+// is exposed here rather than as metrics labels, which must stay bounded.
+func (d *Driver) serveDebugVolumes(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.published.list()); err != nil {
+		klog.Errorf("Failed to write published volumes: %v", err)
+	}
+}
+
+// reconcilePublished rebuilds the published target map from the kernel mount
+// table after a restart, from both the bind mounts of volume directories and
+// the mounts of loop-backed volumes, then marks the node service ready.
+// Until it does, node RPCs are rejected so that a publish cannot race a
+// mount we have not recorded yet.
+func (d *Driver) reconcilePublished() {
+	defer d.nodeReady.Store(true)
+
+	mounts, err := readMountInfo(d.opts.MountInfoPath)
+	if err != nil {
+		klog.Errorf("Mount reconciliation failed, starting with no known mounts: %v", err)
+		return
+	}
+	targets := volumeMounts(mounts, d.stateDir)
+	if targets == nil {
+		targets = make(map[string]string)
+	}
+	for target, volumeID := range loopVolumeMounts(mounts, d.stateDir) {
+		targets[target] = volumeID
+	}
+	for target, volumeID := range targets {
+		d.published.record(target, volumeID)
+		klog.V(2).Infof("Reconciled mount: id=%s target=%s", volumeID, target)
+	}
+	klog.Infof("Mount reconciliation done: %d published volume(s) found", len(targets))
+}
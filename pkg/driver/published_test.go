@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublishedTargetsLimit(t *testing.T) {
+	p := newPublishedTargets(2)
+	if err := p.claim("/pods/a/vol", "vol-1"); err != nil {
+		t.Fatalf("claim vol-1: %v", err)
+	}
+	if err := p.claim("/pods/b/vol", "vol-2"); err != nil {
+		t.Fatalf("claim vol-2: %v", err)
+	}
+	// A volume that is already published does not take another slot.
+	if err := p.claim("/pods/c/vol", "vol-1"); err != nil {
+		t.Fatalf("claim vol-1 at a second target: %v", err)
+	}
+
+	if err := p.claim("/pods/d/vol", "vol-3"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("claim over the limit: got %v, want ResourceExhausted", err)
+	}
+
+	p.release("/pods/b/vol")
+	if err := p.claim("/pods/d/vol", "vol-3"); err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+}
+
+func TestPublishedTargetsConflict(t *testing.T) {
+	p := newPublishedTargets(0)
+	if err := p.claim("/pods/a/vol", "vol-1"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := p.claim("/pods/a/vol/", "vol-1"); err != nil {
+		t.Errorf("repeated claim: %v", err)
+	}
+	if err := p.claim("/pods/a/vol", "vol-2"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("claim by another volume: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestNodePublishVolumeLimit(t *testing.T) {
+	requireMounts(t)
+	dir := t.TempDir()
+	staging := func(id string) string { return filepath.Join(dir, id, "staging") }
+	target := func(id string) string { return filepath.Join(dir, id, "target") }
+
+	// Every volume is staged and already bound at its target, so publishes
+	// only have to claim a slot and unpublishes find nothing to unmount.
+	lines := []string{"1 0 8:1 / / rw - ext4 /dev/sda1 rw"}
+	for i, id := range []string{"vol-1", "vol-2", "vol-3"} {
+		lines = append(lines,
+			fmt.Sprintf("%d 1 8:1 /var/lib/demo/%s %s rw - ext4 /dev/sda1 rw", 10+2*i, id, staging(id)),
+			fmt.Sprintf("%d 1 8:1 /var/lib/demo/%s %s rw - ext4 /dev/sda1 rw", 11+2*i, id, target(id)))
+	}
+	d := newTestDriver(t, Options{MaxVolumesPerNode: 2, MountInfoPath: writeMountInfo(t, lines...)})
+	ns := &nodeServer{d: d}
+	ctx := context.Background()
+	publish := func(id string) error {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: staging(id),
+			TargetPath:        target(id),
+			VolumeCapability:  mountCapability(),
+		})
+		return err
+	}
+
+	info, err := ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetInfo: %v", err)
+	}
+	if info.GetMaxVolumesPerNode() != 2 {
+		t.Errorf("NodeGetInfo MaxVolumesPerNode = %d, want 2", info.GetMaxVolumesPerNode())
+	}
+
+	for _, id := range []string{"vol-1", "vol-2"} {
+		if err := publish(id); err != nil {
+			t.Fatalf("NodePublishVolume %s: %v", id, err)
+		}
+	}
+	if err := publish("vol-3"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("NodePublishVolume over the limit: got %v, want ResourceExhausted", err)
+	}
+	if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: target("vol-1")}); err != nil {
+		t.Fatalf("NodeUnpublishVolume: %v", err)
+	}
+	if err := publish("vol-3"); err != nil {
+		t.Errorf("NodePublishVolume after an unpublish: %v", err)
+	}
+}
+
+func TestReconcilePublished(t *testing.T) {
+	pods := t.TempDir()
+	dirTarget := filepath.Join(pods, "a", "vol")
+	loopTarget := filepath.Join(pods, "b", "vol")
+	blockTarget := filepath.Join(pods, "c", "dev")
+	d := newTestDriver(t, Options{ReconcileMounts: true})
+	fakeLoopDevice(t, "loop3", d.imagePath("vol-2"))
+	fakeLoopDevice(t, "loop4", d.imagePath("vol-3"))
+	fakeLoopDevice(t, "loop5", "/elsewhere/other.img")
+	d.opts.MountInfoPath = writeMountInfo(t,
+		"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+		"2 1 0:5 / /dev rw - devtmpfs devtmpfs rw",
+		// A directory volume bound at its target.
+		"3 1 8:1 "+filepath.Join(d.stateDir, "vol-1")+" "+dirTarget+" rw - ext4 /dev/sda1 rw",
+		// A loop filesystem volume staged and bound at its target.
+		"4 1 7:3 / "+filepath.Join(pods, "staging")+" rw - ext4 /dev/loop3 rw",
+		"5 1 7:3 / "+loopTarget+" rw - ext4 /dev/loop3 rw",
+		// A raw block volume: a bind of the loop device node.
+		"6 1 0:5 /loop4 "+blockTarget+" rw - devtmpfs devtmpfs rw",
+		// Mounts of other loop images and other directories are not ours.
+		"7 1 7:5 / "+filepath.Join(pods, "d", "vol")+" rw - ext4 /dev/loop5 rw",
+		"8 1 8:1 /srv/data "+filepath.Join(pods, "e", "vol")+" rw - ext4 /dev/sda1 rw",
+	)
+	ns := &nodeServer{d: d}
+	ctx := context.Background()
+
+	_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-9",
+		StagingTargetPath: filepath.Join(pods, "staging-9"),
+		TargetPath:        dirTarget,
+		VolumeCapability:  mountCapability(),
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("NodePublishVolume before reconciliation: got %v, want Unavailable", err)
+	}
+	_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: dirTarget})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("NodeUnpublishVolume before reconciliation: got %v, want Unavailable", err)
+	}
+
+	d.reconcilePublished()
+	if !d.nodeReady.Load() {
+		t.Fatal("node not ready after reconciliation")
+	}
+	want := []publishedTarget{
+		{VolumeID: "vol-1", Target: dirTarget},
+		{VolumeID: "vol-2", Target: loopTarget},
+		{VolumeID: "vol-2", Target: filepath.Join(pods, "staging")},
+		{VolumeID: "vol-3", Target: blockTarget},
+	}
+	if got := d.published.list(); !slices.Equal(got, want) {
+		t.Errorf("reconciled targets = %v, want %v", got, want)
+	}
+	// The recovered record now guards the target against another volume.
+	if err := d.published.claim(dirTarget, "vol-9"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("claim of a reconciled target: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestNodePublishVolumeTargetInUse(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	staging := func(id string) string { return filepath.Join(dir, id) }
+	// Both volumes are staged and vol-1 is already bound at target, so the
+	// first publish has nothing to mount.
+	d := newTestDriver(t, Options{MountInfoPath: writeMountInfo(t,
+		"1 0 8:1 / / rw - ext4 /dev/sda1 rw",
+		"2 1 8:1 /var/lib/demo/vol-1 "+staging("vol-1")+" rw - ext4 /dev/sda1 rw",
+		"3 1 8:1 /var/lib/demo/vol-2 "+staging("vol-2")+" rw - ext4 /dev/sda1 rw",
+		"4 1 8:1 /var/lib/demo/vol-1 "+target+" rw - ext4 /dev/sda1 rw",
+	)})
+	ns := &nodeServer{d: d}
+	publish := func(id string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: staging(id),
+			TargetPath:        target,
+			VolumeCapability:  mountCapability(),
+		})
+		return err
+	}
+
+	if err := publish("vol-1"); err != nil {
+		t.Fatalf("NodePublishVolume vol-1: %v", err)
+	}
+	if err := publish("vol-2"); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("NodePublishVolume vol-2 at vol-1's target: got %v, want FailedPrecondition", err)
+	}
+	if err := publish("vol-1"); err != nil {
+		t.Errorf("repeated NodePublishVolume vol-1: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// paramProjectQuota is the StorageClass parameter that asks for the volume's
+// capacity to be enforced with an XFS project quota.
+const paramProjectQuota = "project-quota"
+
+// wantsQuota reports whether params request quota enforcement.
+func wantsQuota(params map[string]string) bool {
+	return params[paramProjectQuota] == "true"
+}
+
+// checkQuotaSupported returns an error status if a quota-enforced volume
+// cannot be created on this driver instance.
+func (d *Driver) checkQuotaSupported() error {
+	if !d.opts.EnableQuota {
+		return status.Errorf(codes.InvalidArgument, "parameter %s requires the driver to run with --enable-quota", paramProjectQuota)
+	}
+	if !d.fsFeatures.projectQuota {
+		return status.Errorf(codes.ResourceExhausted, "project quotas are not supported on %s", d.fsType)
+	}
+	return nil
+}
+
+// assignProjectQuota gives volumeDir a project ID that is not used by any
+// other volume, limits it to capacityBytes, and records the ID in meta. meta
+// is saved before quotaMu is released: nextProjectID only sees IDs on disk,
+// so a concurrent call would otherwise pick the same one.
+func (d *Driver) assignProjectQuota(ctx context.Context, volumeID, volumeDir string, capacityBytes int64, meta *volumeMeta) error {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+
+	projectID, err := d.nextProjectID()
+	if err != nil {
+		return status.Errorf(codes.ResourceExhausted, "failed to allocate project ID: %v", err)
+	}
+	if err := d.xfsQuota(ctx, fmt.Sprintf("project -s -p %s %d", volumeDir, projectID)); err != nil {
+		return status.Errorf(codes.ResourceExhausted, "failed to assign project %d to %q: %v", projectID, volumeDir, err)
+	}
+	if err := d.setQuotaLimit(ctx, projectID, capacityBytes); err != nil {
+		return err
+	}
+	meta.ProjectID = projectID
+	if err := d.saveMeta(volumeID, meta); err != nil {
+		return fsError(err, "failed to write metadata for volume %s", volumeID)
+	}
+	klog.Infof("Quota: id=%s project=%d limit=%d", volumeID, projectID, capacityBytes)
+	return nil
+}
+
+// setQuotaLimit sets the hard block limit of projectID; 0 removes the limit.
+func (d *Driver) setQuotaLimit(ctx context.Context, projectID uint32, bytes int64) error {
+	if err := d.xfsQuota(ctx, fmt.Sprintf("limit -p bhard=%d %d", bytes, projectID)); err != nil {
+		return status.Errorf(codes.ResourceExhausted, "failed to set quota of project %d to %d bytes: %v", projectID, bytes, err)
+	}
+	return nil
+}
+
+// nextProjectID returns one more than the highest project ID recorded in any
+// volume's metadata. Callers hold quotaMu.
+func (d *Driver) nextProjectID() (uint32, error) {
+	entries, err := os.ReadDir(d.stateDir)
+	if err != nil {
+		return 0, err
+	}
+	var highest uint32
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		meta, err := d.loadMeta(e.Name())
+		if err != nil {
+			continue
+		}
+		if meta.ProjectID > highest {
+			highest = meta.ProjectID
+		}
+	}
+	if highest == ^uint32(0) {
+		return 0, fmt.Errorf("project IDs exhausted")
+	}
+	return highest + 1, nil
+}
+
+// xfsQuotaCommand is the xfs_quota binary; tests replace it.
+var xfsQuotaCommand = "xfs_quota"
+
+// xfsQuota runs an xfs_quota expert command against the filesystem that
+// holds stateDir.
+func (d *Driver) xfsQuota(ctx context.Context, command string) error {
+	mounts, err := readMountInfo(d.opts.MountInfoPath)
+	if err != nil {
+		return fmt.Errorf("failed to read mount table: %w", err)
+	}
+	m, ok := containingMount(mounts, d.stateDir)
+	if !ok {
+		return fmt.Errorf("no mount found for %s", d.stateDir)
+	}
+	out, err := exec.CommandContext(ctx, xfsQuotaCommand, "-x", "-c", command, m.MountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("xfs_quota -c %q: %w: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestProjectIDsUniqueUnderConcurrency(t *testing.T) {
+	// Accept every xfs_quota command; only the ID allocation is under test.
+	old := xfsQuotaCommand
+	xfsQuotaCommand = "true"
+	t.Cleanup(func() { xfsQuotaCommand = old })
+
+	d := newTestDriver(t, Options{EnableQuota: true, FSType: "xfs"})
+	cs := &controllerServer{d: d}
+
+	const volumes = 20
+	var wg sync.WaitGroup
+	for i := 0; i < volumes; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+				Parameters:         map[string]string{paramProjectQuota: "true"},
+			})
+			if err != nil {
+				t.Errorf("CreateVolume %s: %v", name, err)
+			}
+		}(fmt.Sprintf("vol-%d", i))
+	}
+	wg.Wait()
+
+	owners := make(map[uint32]string)
+	for i := 0; i < volumes; i++ {
+		id := fmt.Sprintf("vol-%d", i)
+		meta, err := d.loadMeta(id)
+		if err != nil {
+			t.Fatalf("loadMeta %s: %v", id, err)
+		}
+		if meta.ProjectID == 0 {
+			t.Errorf("%s has no project ID", id)
+		}
+		if other, ok := owners[meta.ProjectID]; ok {
+			t.Errorf("%s and %s share project ID %d", other, id, meta.ProjectID)
+		}
+		owners[meta.ProjectID] = id
+	}
+}
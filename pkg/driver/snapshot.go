@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// snapshotInfo is stored next to each snapshot directory as <id>.json. Its
+// presence marks the snapshot as complete.
+type snapshotInfo struct {
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	CreationTime   time.Time `json:"creationTime"`
+	SizeBytes      int64     `json:"sizeBytes"`
+}
+
+func (d *Driver) snapshotPath(snapshotID string) string {
+	return filepath.Join(d.opts.SnapshotDir, snapshotID)
+}
+
+func (d *Driver) snapshotInfoPath(snapshotID string) string {
+	return filepath.Join(d.opts.SnapshotDir, snapshotID+".json")
+}
+
+// loadSnapshotInfo reads the info of snapshotID. It returns an error
+// satisfying os.IsNotExist when the snapshot does not exist.
+func (d *Driver) loadSnapshotInfo(snapshotID string) (*snapshotInfo, error) {
+	data, err := os.ReadFile(d.snapshotInfoPath(snapshotID))
+	if err != nil {
+		return nil, err
+	}
+	var info snapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot info for %s: %w", snapshotID, err)
+	}
+	return &info, nil
+}
+
+func (info *snapshotInfo) toCSI(snapshotID string) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snapshotID,
+		SourceVolumeId: info.SourceVolumeID,
+		CreationTime:   timestamppb.New(info.CreationTime),
+		SizeBytes:      info.SizeBytes,
+		ReadyToUse:     true,
+	}
+}
+
+// writeFileAtomic writes data to path via a temporary file in the same
+// directory and a rename, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CreateSnapshot copies the source volume's directory into the snapshot
+// directory. Like CreateVolume, the snapshot name is used as its ID, so a
+// repeated call returns the existing snapshot.
+func (s *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name is required")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "source volume ID is required")
+	}
+
+	snapshotID := req.GetName()
+	sourceID := req.GetSourceVolumeId()
+	if err := validateID("snapshot name", snapshotID); err != nil {
+		return nil, err
+	}
+	if err := validateID("source volume ID", sourceID); err != nil {
+		return nil, err
+	}
+	// A retry from the sidecar while the first call is still copying would
+	// otherwise copy into the same temporary directory.
+	unlock, err := s.d.snapshotLocks.lock(ctx, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	info, err := s.d.loadSnapshotInfo(snapshotID)
+	switch {
+	case err == nil:
+		if info.SourceVolumeID != sourceID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", snapshotID, info.SourceVolumeID)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: info.toCSI(snapshotID)}, nil
+	case !os.IsNotExist(err):
+		return nil, status.Errorf(codes.Internal, "failed to load snapshot %s: %v", snapshotID, err)
+	}
+
+	// Copy into a temporary directory first so that a crash mid-copy never
+	// leaves something that looks like a finished snapshot.
+	snapshotDir := s.d.snapshotPath(snapshotID)
+	tmpDir := filepath.Join(s.d.opts.SnapshotDir, ".tmp-"+snapshotID)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, fsError(err, "failed to clean up %q", tmpDir)
+	}
+	size, err := s.d.copySnapshot(ctx, snapshotID, sourceID, tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	if err := os.RemoveAll(snapshotDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fsError(err, "failed to clean up %q", snapshotDir)
+	}
+	if err := os.Rename(tmpDir, snapshotDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fsError(err, "failed to move snapshot into place")
+	}
+
+	// The info file marks the snapshot complete, so make the copy durable
+	// before writing it.
+	if s.d.opts.SnapshotSync {
+		if err := syncFS(snapshotDir); err != nil {
+			return nil, fsError(err, "failed to sync snapshot %s", snapshotID)
+		}
+	}
+
+	info = &snapshotInfo{
+		SourceVolumeID: sourceID,
+		CreationTime:   time.Now().UTC(),
+		SizeBytes:      size,
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode snapshot info: %v", err)
+	}
+	if err := writeFileAtomic(s.d.snapshotInfoPath(snapshotID), data, 0640); err != nil {
+		return nil, fsError(err, "failed to write snapshot info for %s", snapshotID)
+	}
+
+	klog.Infof("CreateSnapshot: id=%s source=%s size=%d", snapshotID, sourceID, size)
+	return &csi.CreateSnapshotResponse{Snapshot: info.toCSI(snapshotID)}, nil
+}
+
+// copySnapshot copies the directory of volume sourceID into dir and returns
+// the bytes copied. The volume is locked shared for the copy, so it cannot be
+// deleted or expanded halfway through.
+func (d *Driver) copySnapshot(ctx context.Context, snapshotID, sourceID, dir string) (int64, error) {
+	unlock, err := d.volumeLocks.rlock(ctx, sourceID)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	sourceDir := filepath.Join(d.stateDir, sourceID)
+	if _, err := os.Stat(sourceDir); err != nil {
+		if os.IsNotExist(err) {
+			return 0, status.Errorf(codes.NotFound, "source volume %s not found", sourceID)
+		}
+		return 0, fsError(err, "failed to stat volume dir %q", sourceDir)
+	}
+	if meta, err := d.loadMeta(sourceID); err == nil && meta.Backing == backingLoop {
+		return 0, status.Errorf(codes.InvalidArgument, "volume %s is loop-backed; snapshots copy directories only", sourceID)
+	}
+	if d.opts.SnapshotSync {
+		if err := syncFS(sourceDir); err != nil {
+			klog.Warningf("CreateSnapshot: id=%s: failed to sync source volume %s, copying anyway: %v", snapshotID, sourceID, err)
+		}
+	}
+	size, err := copyTree(ctx, sourceDir, dir)
+	if err != nil {
+		return 0, fsError(err, "failed to snapshot volume %s", sourceID)
+	}
+	return size, nil
+}
+
+// DeleteSnapshot removes the snapshot directory and its info file.
+// It is idempotent: deleting a non-existent snapshot succeeds.
+func (s *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot ID is required")
+	}
+	snapshotID := req.GetSnapshotId()
+	if err := validateID("snapshot ID", snapshotID); err != nil {
+		return nil, err
+	}
+
+	// Restores from this snapshot hold its lock shared while they copy, and
+	// CreateSnapshot holds it while it is being taken.
+	unlock, ok := s.d.snapshotLocks.tryLock(snapshotID)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s is being created or restored", snapshotID)
+	}
+	defer unlock()
+
+	// Remove the info file first: without it a leftover directory is not
+	// treated as a snapshot.
+	if err := os.Remove(s.d.snapshotInfoPath(snapshotID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fsError(err, "failed to delete snapshot info for %s", snapshotID)
+	}
+	if err := os.RemoveAll(s.d.snapshotPath(snapshotID)); err != nil {
+		return nil, fsError(err, "failed to delete snapshot dir %q", s.d.snapshotPath(snapshotID))
+	}
+
+	klog.Infof("DeleteSnapshot: id=%s", snapshotID)
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// syncFS flushes the filesystem holding path to disk.
+func syncFS(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Syncfs(int(f.Fd()))
+}
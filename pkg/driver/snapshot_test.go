@@ -0,0 +1,196 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// createTestSnapshot snapshots volume sourceID as name.
+func createTestSnapshot(t *testing.T, d *Driver, name, sourceID string) *csi.Snapshot {
+	t.Helper()
+	resp, err := (&controllerServer{d: d}).CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: sourceID,
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot %s: %v", name, err)
+	}
+	return resp.GetSnapshot()
+}
+
+// restoreRequest asks for volume name populated from snapshot snapshotID.
+func restoreRequest(name, snapshotID string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID}},
+		},
+	}
+}
+
+func TestSnapshotLifecycle(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	ctx := context.Background()
+	createTestVolume(t, d, "vol-1")
+	data := filepath.Join(d.stateDir, "vol-1", "data")
+	if err := os.WriteFile(data, []byte("before"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := createTestSnapshot(t, d, "snap-1", "vol-1")
+	if snap.GetSnapshotId() != "snap-1" || snap.GetSourceVolumeId() != "vol-1" || !snap.GetReadyToUse() {
+		t.Errorf("CreateSnapshot = %v, want snap-1 of vol-1, ready to use", snap)
+	}
+	if snap.GetSizeBytes() != int64(len("before")) {
+		t.Errorf("snapshot size = %d, want %d", snap.GetSizeBytes(), len("before"))
+	}
+	// Later writes to the volume do not reach the snapshot, and a repeated
+	// call returns the snapshot already taken.
+	if err := os.WriteFile(data, []byte("after"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	again := createTestSnapshot(t, d, "snap-1", "vol-1")
+	if !again.GetCreationTime().AsTime().Equal(snap.GetCreationTime().AsTime()) || again.GetSizeBytes() != snap.GetSizeBytes() {
+		t.Errorf("repeated CreateSnapshot = %v, want %v", again, snap)
+	}
+
+	if _, err := cs.CreateVolume(ctx, restoreRequest("vol-2", "snap-1")); err != nil {
+		t.Fatalf("CreateVolume from snap-1: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(d.stateDir, "vol-2", "data")); err != nil || string(got) != "before" {
+		t.Errorf("restored content = %q, %v, want %q", got, err, "before")
+	}
+	if _, err := cs.CreateVolume(ctx, restoreRequest("vol-2", "snap-1")); err != nil {
+		t.Errorf("repeated CreateVolume from snap-1: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"}); err != nil {
+			t.Fatalf("DeleteSnapshot #%d: %v", i+1, err)
+		}
+	}
+	if _, err := os.Stat(d.snapshotPath("snap-1")); !os.IsNotExist(err) {
+		t.Errorf("snapshot dir after DeleteSnapshot: %v, want it gone", err)
+	}
+	if _, err := cs.CreateVolume(ctx, restoreRequest("vol-3", "snap-1")); status.Code(err) != codes.NotFound {
+		t.Errorf("CreateVolume from a deleted snapshot: got %v, want NotFound", err)
+	}
+
+	caps, err := cs.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities: %v", err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		advertised = advertised || c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT
+	}
+	if !advertised {
+		t.Error("CREATE_DELETE_SNAPSHOT not advertised")
+	}
+}
+
+func TestCreateSnapshotNameConflict(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	createTestVolume(t, d, "vol-1")
+	createTestVolume(t, d, "vol-2")
+	createTestSnapshot(t, d, "snap-1", "vol-1")
+
+	cs := &controllerServer{d: d}
+	if _, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: "vol-1"}); err != nil {
+		t.Errorf("CreateSnapshot with the same source: %v", err)
+	}
+	_, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: "vol-2"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateSnapshot with another source: got %v, want AlreadyExists", err)
+	}
+	if info, err := d.loadSnapshotInfo("snap-1"); err != nil || info.SourceVolumeID != "vol-1" {
+		t.Errorf("snapshot info after the conflict = %v, %v, want source vol-1", info, err)
+	}
+}
+
+func TestSnapshotSyncLeavesSourceWritable(t *testing.T) {
+	d := newTestDriver(t, Options{SnapshotSync: true})
+	cs := &controllerServer{d: d}
+	createTestVolume(t, d, "vol-1")
+	volumeDir := filepath.Join(d.stateDir, "vol-1")
+	before, err := os.Stat(volumeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writable := func(when string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(volumeDir, "data"), []byte(when), 0640); err != nil {
+			t.Errorf("source not writable %s: %v", when, err)
+		}
+		fi, err := os.Stat(volumeDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != before.Mode() {
+			t.Errorf("source mode %s = %v, want %v", when, fi.Mode(), before.Mode())
+		}
+	}
+	writable("before a snapshot")
+
+	snap := createTestSnapshot(t, d, "snap-1", "vol-1")
+	if snap.GetSizeBytes() != int64(len("before a snapshot")) {
+		t.Errorf("snapshot size = %d, want %d", snap.GetSizeBytes(), len("before a snapshot"))
+	}
+	writable("after a snapshot")
+
+	// A cancelled context fails the copy after the source has been synced.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-2", SourceVolumeId: "vol-1"}); err == nil {
+		t.Fatal("CreateSnapshot with a cancelled context succeeded")
+	}
+	writable("after a failed snapshot")
+	if _, err := d.loadSnapshotInfo("snap-2"); !os.IsNotExist(err) {
+		t.Errorf("failed snapshot left info behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.opts.SnapshotDir, ".tmp-snap-2")); !os.IsNotExist(err) {
+		t.Errorf("failed snapshot left its temporary copy behind: %v", err)
+	}
+}
+
+func TestDeleteSnapshotDuringRestore(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	cs := &controllerServer{d: d}
+	ctx := context.Background()
+	createTestVolume(t, d, "vol-1")
+	createTestSnapshot(t, d, "snap-a", "vol-1")
+	createTestSnapshot(t, d, "snap-b", "vol-1")
+
+	// Hold snap-a the way CreateVolume does while it copies a restore.
+	unlock, err := d.snapshotLocks.rlock(ctx, "snap-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other restores from snap-a share the lock.
+	if _, err := cs.CreateVolume(ctx, restoreRequest("vol-2", "snap-a")); err != nil {
+		t.Errorf("CreateVolume from snap-a during another restore: %v", err)
+	}
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-b"}); err != nil {
+		t.Errorf("DeleteSnapshot snap-b during a restore from snap-a: %v", err)
+	}
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-a"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeleteSnapshot snap-a during its restore: got %v, want FailedPrecondition", err)
+	}
+	if _, err := d.loadSnapshotInfo("snap-a"); err != nil {
+		t.Errorf("snap-a after the refused delete: %v", err)
+	}
+
+	unlock()
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-a"}); err != nil {
+		t.Errorf("DeleteSnapshot snap-a after the restore: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package driver
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// topologyKeyNode is the topology segment that pins a volume to the node
+// whose state dir holds it.
+const topologyKeyNode = "topology." + driverName + "/node"
+
+// nodeTopology returns the topology of this driver instance's node.
+func (d *Driver) nodeTopology() *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{topologyKeyNode: d.nodeID}}
+}
+
+// accessibleTopology returns the topology a new volume is accessible from.
+// The volume is created on this node, so the only segment that can be
+// honoured is this node's: it is echoed back when the requirement allows it
+// and ResourceExhausted is returned when the requisite list excludes it.
+func (d *Driver) accessibleTopology(req *csi.TopologyRequirement) ([]*csi.Topology, error) {
+	own := d.nodeTopology()
+	if len(req.GetRequisite()) == 0 {
+		return []*csi.Topology{own}, nil
+	}
+	for _, t := range req.GetRequisite() {
+		if t.GetSegments()[topologyKeyNode] == d.nodeID {
+			return []*csi.Topology{own}, nil
+		}
+	}
+	return nil, status.Errorf(codes.ResourceExhausted, "requisite topology does not include node %s", d.nodeID)
+}
@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	d := newTestDriver(t, Options{})
+	resp, err := (&nodeServer{d: d}).NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetInfo: %v", err)
+	}
+	segments := resp.GetAccessibleTopology().GetSegments()
+	if len(segments) != 1 || segments[topologyKeyNode] != "test-node" {
+		t.Errorf("topology segments = %v, want %s=test-node", segments, topologyKeyNode)
+	}
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	node := func(id string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{topologyKeyNode: id}}
+	}
+	tests := []struct {
+		name     string
+		req      *csi.TopologyRequirement
+		wantCode codes.Code
+	}{
+		{name: "no requirement"},
+		{name: "this node requisite", req: &csi.TopologyRequirement{Requisite: []*csi.Topology{node("other-node"), node("test-node")}}},
+		{name: "preferred only", req: &csi.TopologyRequirement{Preferred: []*csi.Topology{node("other-node")}}},
+		{name: "other nodes requisite", req: &csi.TopologyRequirement{Requisite: []*csi.Topology{node("other-node")}}, wantCode: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := &controllerServer{d: newTestDriver(t, Options{})}
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:                      "vol-1",
+				VolumeCapabilities:        []*csi.VolumeCapability{mountCapability()},
+				AccessibilityRequirements: tt.req,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolume: got %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			topo := resp.GetVolume().GetAccessibleTopology()
+			if len(topo) != 1 || topo[0].GetSegments()[topologyKeyNode] != "test-node" {
+				t.Errorf("AccessibleTopology = %v, want only this node", topo)
+			}
+		})
+	}
+}
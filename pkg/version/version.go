@@ -0,0 +1,43 @@
+// Package version holds the build metadata of the driver binary. The
+// variables are set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/example/demo-csi-plugin/pkg/version.version=v0.2.0" ./cmd/
+//
+// The Makefile and the Dockerfile set all three.
+package version
+
+var (
+	version   string
+	gitCommit string
+	buildDate string
+)
+
+// devVersion is reported when the binary was built without -ldflags.
+const devVersion = "v0.0.0-dev"
+
+// Version returns the driver version, or v0.0.0-dev if it was not set.
+func Version() string {
+	if version == "" {
+		return devVersion
+	}
+	return version
+}
+
+// GitCommit returns the commit the binary was built from, or "" if unknown.
+func GitCommit() string {
+	return gitCommit
+}
+
+// BuildDate returns when the binary was built, or "" if unknown.
+func BuildDate() string {
+	return buildDate
+}
+
+// SetForTesting replaces the build metadata as -ldflags would and returns a
+// function restoring the previous values. It lets tests of packages that
+// report the metadata cover the linked-in case.
+func SetForTesting(v, commit, date string) (restore func()) {
+	oldVersion, oldCommit, oldDate := version, gitCommit, buildDate
+	version, gitCommit, buildDate = v, commit, date
+	return func() { version, gitCommit, buildDate = oldVersion, oldCommit, oldDate }
+}
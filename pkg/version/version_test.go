@@ -0,0 +1,29 @@
+package version
+
+import "testing"
+
+func TestVersion(t *testing.T) {
+	linked := [3]string{version, gitCommit, buildDate}
+	restore := SetForTesting("", "", "")
+	defer restore()
+	if got := Version(); got != devVersion {
+		t.Errorf("Version() = %q without ldflags, want %q", got, devVersion)
+	}
+
+	// What go build -ldflags "-X .../pkg/version.version=v1.2.3 ..." sets.
+	version, gitCommit, buildDate = "v1.2.3", "0123abc", "2024-01-02T03:04:05Z"
+	if got := Version(); got != "v1.2.3" {
+		t.Errorf("Version() = %q, want v1.2.3", got)
+	}
+	if got := GitCommit(); got != "0123abc" {
+		t.Errorf("GitCommit() = %q, want 0123abc", got)
+	}
+	if got := BuildDate(); got != "2024-01-02T03:04:05Z" {
+		t.Errorf("BuildDate() = %q, want 2024-01-02T03:04:05Z", got)
+	}
+
+	restore()
+	if got := [3]string{version, gitCommit, buildDate}; got != linked {
+		t.Errorf("restore left %q, want %q", got, linked)
+	}
+}